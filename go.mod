@@ -5,9 +5,11 @@ go 1.24.3
 require (
 	github.com/deckarep/golang-set/v2 v2.8.0
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728
 	github.com/pelletier/go-toml/v2 v2.2.4
 	github.com/sashabaranov/go-openai v1.40.2
 	github.com/spf13/viper v1.20.1
+	github.com/yuin/goldmark v1.8.6
 	modernc.org/sqlite v1.38.0
 )
 
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const blobDirName = "blobs"
+
+func blobDir() string {
+	return filepath.Join(util.GetDataDir(), blobDirName)
+}
+
+// messageAttachments returns the files of a message that are kept in history.
+func messageAttachments(msg *botapi.Message) []Attachment {
+	var attachments []Attachment
+	if len(msg.Photo) > 0 {
+		photo := msg.Photo[len(msg.Photo)-1]
+		attachments = append(attachments, Attachment{Kind: AttachmentImage, FileID: photo.FileID, FileUniqueID: photo.FileUniqueID})
+	}
+	return attachments
+}
+
+// loadAttachment reads an attachment from the blob cache, downloading it from Telegram on a miss.
+func loadAttachment(botState *State, attachment Attachment) ([]byte, error) {
+	path := filepath.Join(blobDir(), filepath.Base(attachment.FileUniqueID))
+	if data, err := os.ReadFile(path); err == nil {
+		return data, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to read cached attachment", "path", path, "error", err)
+	}
+
+	data, err := util.DownloadFile(attachment.FileID, botState.Bot)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(blobDir(), 0755); err != nil {
+		slog.Warn("failed to create blob directory", "error", err)
+	} else if err := os.WriteFile(path, data, 0644); err != nil {
+		slog.Warn("failed to cache attachment", "path", path, "error", err)
+	}
+	return data, nil
+}
+
+// loadAttachments fetches the most recent images of records, at most budget of them,
+// and the audio of the latest record. The latest record is the prompt being answered,
+// so its images are always included.
+func loadAttachments(botState *State, records []ChatRecord, budget int) map[string][]byte {
+	blobs := make(map[string][]byte)
+	images := 0
+	for i := len(records) - 1; i >= 0; i-- {
+		latest := i == len(records)-1
+		for j := len(records[i].Attachments) - 1; j >= 0; j-- {
+			attachment := records[i].Attachments[j]
+			if _, ok := blobs[attachment.FileUniqueID]; ok {
+				continue
+			}
+			switch {
+			case attachment.Kind == AttachmentImage && !latest && images >= budget:
+				return blobs
+			case attachment.Kind == AttachmentAudio && !latest:
+				continue
+			}
+			blob, err := loadAttachment(botState, attachment)
+			if err == nil && attachment.Kind == AttachmentImage {
+				_, err = util.DetectImageType(blob)
+			}
+			if err != nil {
+				slog.Error("failed to retrieve attachment", "error", err, "file_id", attachment.FileID)
+				continue
+			}
+			if attachment.Kind == AttachmentImage {
+				images++
+			}
+			blobs[attachment.FileUniqueID] = blob
+		}
+	}
+	return blobs
+}
+
+// tidyBlobs removes cached files that no attachment refers to anymore.
+func tidyBlobs(botState *State) (int, error) {
+	keys, err := AttachmentKeys(botState.DB)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(blobDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || keys[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir(), entry.Name())); err != nil {
+			slog.Warn("failed to remove blob", "name", entry.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
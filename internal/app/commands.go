@@ -2,8 +2,10 @@ package app
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 
 	"log/slog"
@@ -30,11 +32,51 @@ func handleCommand(botState *State, inMsg *botapi.Message, session *Session) {
 	case "chat":
 		handleChatAction(botState, inMsg, session)
 	case "new":
-		session.ChatRecords = make([]ChatRecord, 0, 16)
-		tryStoppingResponse(session)
-		tryDrainingResponseChannel(session)
-		ClearChatRecords(botState.DB, session.ID)
+		discardResponse(session)
+		// An empty conversation is simply reused.
+		if len(session.ChatRecords) > 0 || session.Summary != "" {
+			if err := startConversation(botState, session); err != nil {
+				slog.Error("failed to start conversation", "error", err)
+				util.SendMessageQuick(inMsg.Chat.ID, "Failed to start a new conversation.", botState.Bot)
+				return
+			}
+		}
 		util.SendMessageQuick(inMsg.Chat.ID, "New conversation started.", botState.Bot)
+	case "convs":
+		conversations, err := ListConversations(botState.DB, session.ID, conversationListLimit)
+		if err != nil {
+			slog.Error("failed to list conversations", "error", err)
+			util.SendMessageQuick(inMsg.Chat.ID, "Failed to list conversations.", botState.Bot)
+			return
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, formatConversations(conversations, session.ConversationID), botState.Bot)
+	case "open":
+		conversation, err := conversationAt(botState, session, inMsg.CommandArguments())
+		if err == nil {
+			discardResponse(session)
+			err = openConversation(botState, session, conversation.ID)
+		}
+		if err != nil {
+			slog.Warn("failed to open conversation", "error", err)
+			util.SendMessageQuick(inMsg.Chat.ID, "Conversation not found.", botState.Bot)
+			return
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Opened conversation: %s", displayTitle(conversation)), botState.Bot)
+	case "delete":
+		conversation, err := conversationAt(botState, session, inMsg.CommandArguments())
+		if err != nil {
+			slog.Warn("failed to delete conversation", "error", err)
+			util.SendMessageQuick(inMsg.Chat.ID, "Conversation not found.", botState.Bot)
+			return
+		}
+		DeleteConversation(botState.DB, conversation.ID)
+		if conversation.ID == session.ConversationID {
+			discardResponse(session)
+			if err := startConversation(botState, session); err != nil {
+				slog.Error("failed to start conversation", "error", err)
+			}
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, "Conversation deleted.", botState.Bot)
 	case "set":
 		modelAlias := inMsg.CommandArguments()
 		model, exists := botState.CachedModelMap[modelAlias]
@@ -49,7 +91,7 @@ func handleCommand(botState *State, inMsg *botapi.Message, session *Session) {
 			return
 		}
 		session.Model = modelAlias
-		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt)
+		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
 		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Current model: %s (%s) by %s", model.Name, modelAlias, model.Provider), botState.Bot)
 	case "list":
 		modelList := "Available models:\n"
@@ -60,18 +102,80 @@ func handleCommand(botState *State, inMsg *botapi.Message, session *Session) {
 			modelList += fmt.Sprintf("%s: %s by %s\n", alias, model.Name, model.Provider)
 		}
 		util.SendMessageQuick(inMsg.Chat.ID, modelList, botState.Bot)
+	case "fork":
+		reply := inMsg.ReplyToMessage
+		if reply == nil {
+			util.SendMessageQuick(inMsg.Chat.ID, "Reply to a message with /fork to continue from there in a new conversation.", botState.Bot)
+			return
+		}
+		conversationID, recordID, err := FindRecordByMessage(botState.DB, session.ID, inMsg.Chat.ID, reply.MessageID)
+		if err != nil {
+			slog.Warn("failed to find forked message", "message_id", reply.MessageID, "error", err)
+			util.SendMessageQuick(inMsg.Chat.ID, "Message not found in history.", botState.Bot)
+			return
+		}
+		forkID, err := ForkConversation(botState.DB, session.ID, conversationID, recordID)
+		if err == nil {
+			discardResponse(session)
+			err = openConversation(botState, session, forkID)
+		}
+		if err != nil {
+			slog.Error("failed to fork conversation", "error", err)
+			util.SendMessageQuick(inMsg.Chat.ID, "Failed to fork conversation.", botState.Bot)
+			return
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, "Forked into a new conversation.", botState.Bot)
 	case "undo":
+		discardResponse(session)
 		if len(session.ChatRecords) > 0 {
 			if session.ChatRecords[len(session.ChatRecords)-1].Role == RoleBot {
 				session.ChatRecords = session.ChatRecords[:len(session.ChatRecords)-1]
-				DeleteLastChatRecord(botState.DB, session.ID)
+				DeleteLastChatRecord(botState.DB, session.ConversationID)
 			}
 			if len(session.ChatRecords) > 0 && session.ChatRecords[len(session.ChatRecords)-1].Role == RoleUser {
 				session.ChatRecords = session.ChatRecords[:len(session.ChatRecords)-1]
-				DeleteLastChatRecord(botState.DB, session.ID)
+				DeleteLastChatRecord(botState.DB, session.ConversationID)
 			}
 		}
 		util.SendMessageQuick(inMsg.Chat.ID, "Last round of conversation undone.", botState.Bot)
+	case "summary":
+		if session.Summary == "" {
+			util.SendMessageQuick(inMsg.Chat.ID, "No summary of this conversation yet.", botState.Bot)
+			return
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, "Summary of the earlier conversation:\n\n"+session.Summary, botState.Bot)
+	case "speak":
+		if botState.Config.SpeechModel == "" {
+			util.SendMessageQuick(inMsg.Chat.ID, "Text-to-speech is not configured.", botState.Bot)
+			return
+		}
+		var content string
+		for i := len(session.ChatRecords) - 1; i >= 0 && content == ""; i-- {
+			if session.ChatRecords[i].Role == RoleBot {
+				content = session.ChatRecords[i].Content
+			}
+		}
+		if content == "" {
+			util.SendMessageQuick(inMsg.Chat.ID, "No reply to speak yet.", botState.Bot)
+			return
+		}
+		// Speech takes a while, so the session is not held up by it.
+		botState.Responses.Add(1)
+		go func() {
+			defer botState.Responses.Done()
+			if err := speak(botState, inMsg.Chat.ID, content); err != nil {
+				slog.Error("failed to speak reply", "error", err)
+				util.SendMessageQuick(inMsg.Chat.ID, "Failed to speak the reply.", botState.Bot)
+			}
+		}()
+	case "voice":
+		session.VoiceReplies = !session.VoiceReplies
+		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
+		if session.VoiceReplies {
+			util.SendMessageQuick(inMsg.Chat.ID, "Voice messages will be answered with voice too.", botState.Bot)
+		} else {
+			util.SendMessageQuick(inMsg.Chat.ID, "Voice replies are off.", botState.Bot)
+		}
 	case "stop":
 		tryStoppingResponse(session)
 		util.SendMessageQuick(inMsg.Chat.ID, "Tried stopping the last response.", botState.Bot)
@@ -84,7 +188,7 @@ func handleCommand(botState *State, inMsg *botapi.Message, session *Session) {
 			return
 		}
 		session.Temperature = float32(temp)
-		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt)
+		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
 		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Current temperature: %.2f.", temp), botState.Bot)
 	case "help":
 		util.SendMessageQuick(inMsg.Chat.ID, helpTxt, botState.Bot)
@@ -102,17 +206,20 @@ func handleCommand(botState *State, inMsg *botapi.Message, session *Session) {
 			return
 		}
 		session.Prompt = promptName
-		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt)
+		UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
 		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Current system prompt: %s.", promptName), botState.Bot)
 	default:
 		if isAdmin(botState.Config.Admins, inMsg.From.ID) {
-			handleAdminCommand(botState, inMsg)
+			handleAdminCommand(botState, inMsg, session)
 		}
 	}
 }
 
 // handleAdminCommand executes admin-only commands.
-func handleAdminCommand(botState *State, inMsg *botapi.Message) {
+// The caller holds the lock of the current session. Commands that need other sessions
+// release it first and then lock every session in ID order, so that they cannot deadlock
+// with each other.
+func handleAdminCommand(botState *State, inMsg *botapi.Message, current *Session) {
 	cmd := inMsg.Command()
 	slog.Info("processing admin command",
 		"command", cmd,
@@ -131,12 +238,14 @@ func handleAdminCommand(botState *State, inMsg *botapi.Message) {
 		configString := inMsg.CommandArguments()
 		var config util.Config
 		err := toml.Unmarshal([]byte(configString), &config)
+		if err == nil {
+			err = config.Validate()
+		}
 		if err != nil {
 			slog.Error(err.Error())
 			util.SendMessageQuick(inMsg.Chat.ID, "Failed to update configuration.", botState.Bot)
 			return
 		}
-		botState.Config = &config
 		dataDir := util.GetDataDir()
 		configPath := filepath.Join(dataDir, util.ConfigName+"."+util.ConfigType)
 		err = os.WriteFile(configPath, []byte(configString), 0644)
@@ -148,15 +257,22 @@ func handleAdminCommand(botState *State, inMsg *botapi.Message) {
 		util.SendMessageQuick(inMsg.Chat.ID, "Configuration updated. The bot will now shut down or restart.", botState.Bot)
 		os.Exit(0)
 	case "clear":
-		for _, session := range botState.SessionMap {
-			tryStoppingResponse(session)
-			tryDrainingResponseChannel(session)
-			session.ChatRecords = make([]ChatRecord, 0, 16)
+		current.Unlock()
+		defer current.Lock()
+		sessions := lockAllSessions(botState)
+		ClearAllMetadata(botState.DB)
+		ClearAllChatRecords(botState.DB)
+		for _, session := range sessions {
+			discardResponse(session)
 			session.Temperature = botState.Config.DefaultTemperature
 			session.Model = botState.Config.DefaultModel
+			session.VoiceReplies = false
+			UpdateSessionMetadata(botState.DB, session.ID, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
+			if err := startConversation(botState, session); err != nil {
+				slog.Error("failed to start conversation", "user_id", session.ID, "error", err)
+			}
+			session.Unlock()
 		}
-		ClearAllMetadata(botState.DB)
-		ClearAllChatRecords(botState.DB)
 		util.SendMessageQuick(inMsg.Chat.ID, "All session data has been reset.", botState.Bot)
 	case "tidy":
 		// Gather valid session IDs from botState.SessionMap.
@@ -170,8 +286,24 @@ func handleAdminCommand(botState *State, inMsg *botapi.Message) {
 			util.SendMessageQuick(inMsg.Chat.ID, "Failed to tidy sessions.", botState.Bot)
 			return
 		}
-		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Tidy complete. Deleted %d obsolete session(s).", deleted), botState.Bot)
+		removed, err := tidyBlobs(botState)
+		if err != nil {
+			slog.Error("failed to tidy blobs", "error", err)
+		}
+		util.SendMessageQuick(inMsg.Chat.ID, fmt.Sprintf("Tidy complete. Deleted %d obsolete session(s) and %d cached file(s).", deleted, removed), botState.Bot)
+	}
+}
+
+// lockAllSessions locks every session in ID order and returns them in that order.
+func lockAllSessions(botState *State) []*Session {
+	ids := slices.Sorted(maps.Keys(botState.SessionMap))
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session := botState.SessionMap[id]
+		session.Lock()
+		sessions = append(sessions, session)
 	}
+	return sessions
 }
 
 func isAdmin(admins []int64, userID int64) bool {
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	conversationListLimit = 10
+	conversationTitleMax  = 40 // in runes
+)
+
+// startConversation switches the session to a new empty conversation, keeping the current one.
+// Callers discard any in-flight response first.
+func startConversation(botState *State, session *Session) error {
+	id, err := CreateConversation(botState.DB, session.ID)
+	if err != nil {
+		return err
+	}
+	session.ConversationID = id
+	session.ChatRecords = make([]ChatRecord, 0, 16)
+	session.Summary = ""
+	UpdateSessionConversation(botState.DB, session.ID, id)
+	return nil
+}
+
+// openConversation switches the session to a stored conversation.
+// Callers discard any in-flight response first.
+func openConversation(botState *State, session *Session, id int64) error {
+	summary, records, err := LoadConversation(botState.DB, id)
+	if err != nil {
+		return err
+	}
+	session.ConversationID = id
+	session.ChatRecords = append(make([]ChatRecord, 0, len(records)+16), records...)
+	session.Summary = summary
+	UpdateSessionConversation(botState.DB, session.ID, id)
+	return nil
+}
+
+// conversationAt resolves a 1-based position in the list shown by /convs.
+func conversationAt(botState *State, session *Session, arg string) (Conversation, error) {
+	var n int
+	if _, err := fmt.Sscan(arg, &n); err != nil {
+		return Conversation{}, fmt.Errorf("invalid conversation number: %q", arg)
+	}
+	conversations, err := ListConversations(botState.DB, session.ID, conversationListLimit)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if n < 1 || n > len(conversations) {
+		return Conversation{}, fmt.Errorf("conversation number out of range: %d", n)
+	}
+	return conversations[n-1], nil
+}
+
+// formatConversations renders the list shown by /convs.
+func formatConversations(conversations []Conversation, currentID int64) string {
+	var list strings.Builder
+	list.WriteString("Recent conversations:\n")
+	for i, conversation := range conversations {
+		fmt.Fprintf(&list, "%d. %s · %s", i+1, displayTitle(conversation), conversation.UpdatedAt.Format("2006-01-02 15:04"))
+		if conversation.ID == currentID {
+			list.WriteString(" (current)")
+		}
+		list.WriteString("\n")
+	}
+	return list.String()
+}
+
+func displayTitle(conversation Conversation) string {
+	if conversation.Title == "" {
+		return "(untitled)"
+	}
+	return conversation.Title
+}
+
+// conversationTitle derives a title from the first user message of a conversation.
+func conversationTitle(content string) string {
+	title := strings.TrimSpace(content)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = strings.TrimSpace(title[:i])
+	}
+	if utf8.RuneCountInString(title) > conversationTitleMax {
+		title = string([]rune(title)[:conversationTitleMax-1]) + "…"
+	}
+	return title
+}
+
+// setConversationTitle titles the conversation after content if it is the first user message with text.
+func setConversationTitle(botState *State, session *Session, content string) {
+	if content == "" {
+		return
+	}
+	for _, record := range session.ChatRecords {
+		if record.Role == RoleUser && record.Content != "" {
+			return
+		}
+	}
+	if session.Summary != "" {
+		return
+	}
+	UpdateConversationTitle(botState.DB, session.ConversationID, conversationTitle(content))
+	slog.Debug("titled conversation", "session_id", session.ID, "conversation_id", session.ConversationID)
+}
+
+// followReply moves an idle session to the point in history that msg replies to: the conversation
+// of the replied message if it is the latest there, or otherwise a new branch forked from it.
+func followReply(botState *State, session *Session, msg *botapi.Message) {
+	reply := msg.ReplyToMessage
+	if reply == nil {
+		return
+	}
+	conversationID, recordID, err := FindRecordByMessage(botState.DB, session.ID, msg.Chat.ID, reply.MessageID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to look up replied message", "message_id", reply.MessageID, "error", err)
+		}
+		return
+	}
+	lastID, err := LastRecordID(botState.DB, conversationID)
+	if err != nil {
+		slog.Error("failed to look up latest record", "conversation_id", conversationID, "error", err)
+		return
+	}
+
+	if recordID == lastID {
+		if conversationID == session.ConversationID {
+			return
+		}
+		if err := openConversation(botState, session, conversationID); err != nil {
+			slog.Error("failed to open replied conversation", "error", err)
+			return
+		}
+		util.SendMessageQuick(msg.Chat.ID, "Switched to the conversation of the replied message.", botState.Bot)
+		return
+	}
+
+	forkID, err := ForkConversation(botState.DB, session.ID, conversationID, recordID)
+	if err == nil {
+		err = openConversation(botState, session, forkID)
+	}
+	if err != nil {
+		slog.Error("failed to fork replied conversation", "error", err)
+		return
+	}
+	util.SendMessageQuick(msg.Chat.ID, "Continuing from the replied message in a new branch.", botState.Bot)
+}
+
+// quotedContext returns the text of another member's message that msg replies to in a group, as a quote.
+func quotedContext(msg *botapi.Message) string {
+	reply := msg.ReplyToMessage
+	if reply == nil || msg.Chat.IsPrivate() || reply.From == nil || reply.From.IsBot || reply.From.ID == msg.From.ID {
+		return ""
+	}
+	text := reply.Text
+	if text == "" {
+		text = reply.Caption
+	}
+	if text == "" {
+		return ""
+	}
+	name := strings.TrimSpace(reply.From.FirstName + " " + reply.From.LastName)
+	return fmt.Sprintf("[Replying to %s]\n> %s\n\n", name, strings.ReplaceAll(text, "\n", "\n> "))
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"os"
 	"path/filepath"
+	"time"
 
 	"log/slog"
 
@@ -14,8 +15,11 @@ const (
 	dataDbName = "data.db"
 )
 
-// New schema: sessions table holds session_id, model and temperature.
-// chat_records table holds a record id, session_id, role (int) and content.
+// New schema: sessions table holds session_id, model, temperature, prompt and the current conversation.
+// conversations table holds a conversation id, session_id, title, running summary and update time.
+// chat_records table holds a record id, session_id, conversation_id, role (int) and content.
+// record_messages table maps Telegram chat and message ids to the record they carry.
+// attachments table holds the Telegram files of a record, whose content is cached in the blob directory.
 
 func OpenSessionDB(dataDir string) *sql.DB {
 	dbPath := filepath.Join(dataDir, dataDbName)
@@ -29,57 +33,145 @@ func OpenSessionDB(dataDir string) *sql.DB {
 		slog.Error("failed to open session DB", "error", err)
 		return nil
 	}
+	// Sessions are served concurrently, and SQLite allows a single writer at a time.
+	db.SetMaxOpenConns(1)
 	// Create tables if not exist.
 	schema := `
 	CREATE TABLE IF NOT EXISTS sessions (
 		session_id INTEGER PRIMARY KEY,
 		model TEXT,
 		temperature REAL,
-		prompt TEXT
+		prompt TEXT,
+		conversation_id INTEGER,
+		voice_replies INTEGER NOT NULL DEFAULT 0
 	);
+	CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER,
+		title TEXT NOT NULL DEFAULT '',
+		summary TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_conversations_session_id ON conversations(session_id);
 	CREATE TABLE IF NOT EXISTS chat_records (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		session_id INTEGER,
+		conversation_id INTEGER,
 		role INTEGER,
 		content TEXT,
-		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id),
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id)
 	);
 	CREATE INDEX IF NOT EXISTS idx_chat_records_session_id ON chat_records(session_id);
+	CREATE TABLE IF NOT EXISTS record_messages (
+		chat_id INTEGER,
+		message_id INTEGER,
+		record_id INTEGER,
+		PRIMARY KEY(chat_id, message_id),
+		FOREIGN KEY(record_id) REFERENCES chat_records(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_record_messages_record_id ON record_messages(record_id);
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		record_id INTEGER,
+		kind TEXT,
+		file_id TEXT,
+		file_unique_id TEXT,
+		transcript TEXT,
+		FOREIGN KEY(record_id) REFERENCES chat_records(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_record_id ON attachments(record_id);
+	CREATE TRIGGER IF NOT EXISTS delete_record_messages AFTER DELETE ON chat_records
+	BEGIN
+		DELETE FROM record_messages WHERE record_id = OLD.id;
+		DELETE FROM attachments WHERE record_id = OLD.id;
+	END;
 	`
 	if _, err := db.Exec(schema); err != nil {
 		slog.Error("failed to create tables", "error", err)
 	}
 
-	// Check if prompt column exists in sessions table, add it if not
-	var hasPromptColumn bool
-	err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('sessions') WHERE name='prompt'").Scan(&hasPromptColumn)
+	// Tables created by older versions lack the newer columns.
+	ensureColumn(db, "sessions", "prompt", "TEXT")
+	ensureColumn(db, "sessions", "conversation_id", "INTEGER")
+	ensureColumn(db, "sessions", "voice_replies", "INTEGER NOT NULL DEFAULT 0")
+	ensureColumn(db, "chat_records", "conversation_id", "INTEGER REFERENCES conversations(id)")
+	ensureColumn(db, "attachments", "transcript", "TEXT")
+	// Created here rather than with the table, since old tables only have the column from now on.
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_chat_records_conversation_id ON chat_records(conversation_id)"); err != nil {
+		slog.Error("failed to create conversation index", "error", err)
+	}
+	migrateConversations(db)
+
+	return db
+}
+
+// ensureColumn adds a column to a table created by an older version, if it is missing.
+func ensureColumn(db *sql.DB, table string, column string, definition string) {
+	var hasColumn bool
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&hasColumn)
 	if err != nil {
-		slog.Error("failed to check for prompt column", "error", err)
-	} else if !hasPromptColumn {
-		// Add the prompt column to existing sessions table
-		_, err := db.Exec("ALTER TABLE sessions ADD COLUMN prompt TEXT")
+		slog.Error("failed to check for column", "table", table, "column", column, "error", err)
+	} else if !hasColumn {
+		_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
 		if err != nil {
-			slog.Error("failed to add prompt column to sessions table", "error", err)
+			slog.Error("failed to add column", "table", table, "column", column, "error", err)
 		} else {
-			slog.Info("added prompt column to existing sessions table")
+			slog.Info("added column to existing table", "table", table, "column", column)
 		}
 	}
+}
 
-	return db
+// migrateConversations moves the history of sessions from before conversations existed into one.
+func migrateConversations(db *sql.DB) {
+	tx, err := db.Begin()
+	if err != nil {
+		slog.Error("failed to migrate conversations", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`INSERT INTO conversations(session_id, updated_at)
+		SELECT session_id, unixepoch() FROM sessions WHERE conversation_id IS NULL;`,
+		`UPDATE sessions SET conversation_id = (
+			SELECT MAX(id) FROM conversations WHERE conversations.session_id = sessions.session_id)
+		WHERE conversation_id IS NULL;`,
+		`UPDATE chat_records SET conversation_id = (
+			SELECT conversation_id FROM sessions WHERE sessions.session_id = chat_records.session_id)
+		WHERE conversation_id IS NULL;`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			slog.Error("failed to migrate conversations", "error", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to migrate conversations", "error", err)
+	}
 }
 
-func UpdateSessionMetadata(db *sql.DB, sessionID int64, model string, temperature float32, prompt string) {
+func UpdateSessionMetadata(db *sql.DB, sessionID int64, model string, temperature float32, prompt string, voiceReplies bool) {
 	// Upsert sessions row.
 	stmt := `
-	INSERT INTO sessions(session_id, model, temperature, prompt)
-	VALUES(?, ?, ?, ?)
-	ON CONFLICT(session_id) DO UPDATE SET model=excluded.model, temperature=excluded.temperature, prompt=excluded.prompt;
+	INSERT INTO sessions(session_id, model, temperature, prompt, voice_replies)
+	VALUES(?, ?, ?, ?, ?)
+	ON CONFLICT(session_id) DO UPDATE SET model=excluded.model, temperature=excluded.temperature, prompt=excluded.prompt, voice_replies=excluded.voice_replies;
 	`
-	if _, err := db.Exec(stmt, sessionID, model, temperature, prompt); err != nil {
+	if _, err := db.Exec(stmt, sessionID, model, temperature, prompt, voiceReplies); err != nil {
 		slog.Error("failed to update session metadata", "userID", sessionID, "error", err)
 	}
 }
 
+func UpdateSessionConversation(db *sql.DB, sessionID int64, conversationID int64) {
+	stmt := `UPDATE sessions SET conversation_id = ? WHERE session_id = ?;`
+	if _, err := db.Exec(stmt, conversationID, sessionID); err != nil {
+		slog.Error("failed to update session conversation", "userID", sessionID, "error", err)
+	}
+}
+
 func ClearAllMetadata(db *sql.DB) {
 	stmt := `DELETE FROM sessions;`
 	if _, err := db.Exec(stmt); err != nil {
@@ -87,54 +179,208 @@ func ClearAllMetadata(db *sql.DB) {
 	}
 }
 
-func AppendChatRecord(db *sql.DB, sessionID int64, role int, content string) {
+// AppendChatRecord stores a record and returns its id.
+func AppendChatRecord(db *sql.DB, sessionID int64, conversationID int64, role int, content string) (int64, error) {
 	stmt := `
-	INSERT INTO chat_records(session_id, role, content)
-	VALUES(?, ?, ?);
+	INSERT INTO chat_records(session_id, conversation_id, role, content)
+	VALUES(?, ?, ?, ?);
 	`
-	if _, err := db.Exec(stmt, sessionID, role, content); err != nil {
+	res, err := db.Exec(stmt, sessionID, conversationID, role, content)
+	if err != nil {
 		slog.Error("failed to append chat record", "userID", sessionID, "error", err)
+		return 0, err
+	}
+	if _, err := db.Exec("UPDATE conversations SET updated_at = unixepoch() WHERE id = ?;", conversationID); err != nil {
+		slog.Error("failed to touch conversation", "conversationID", conversationID, "error", err)
+	}
+	return res.LastInsertId()
+}
+
+// LinkRecordMessages maps Telegram messages to the record they carry.
+func LinkRecordMessages(db *sql.DB, chatID int64, recordID int64, messageIDs []int) {
+	for _, messageID := range messageIDs {
+		stmt := `INSERT OR REPLACE INTO record_messages(chat_id, message_id, record_id) VALUES(?, ?, ?);`
+		if _, err := db.Exec(stmt, chatID, messageID, recordID); err != nil {
+			slog.Error("failed to link record message", "recordID", recordID, "messageID", messageID, "error", err)
+		}
+	}
+}
+
+// AddAttachments stores the attachments of a record.
+func AddAttachments(db *sql.DB, recordID int64, attachments []Attachment) {
+	for _, attachment := range attachments {
+		stmt := `INSERT INTO attachments(record_id, kind, file_id, file_unique_id, transcript) VALUES(?, ?, ?, ?, ?);`
+		if _, err := db.Exec(stmt, recordID, attachment.Kind, attachment.FileID, attachment.FileUniqueID, attachment.Transcript); err != nil {
+			slog.Error("failed to add attachment", "recordID", recordID, "error", err)
+		}
+	}
+}
+
+// SetAttachmentTranscript stores what was heard in an audio attachment of a record.
+func SetAttachmentTranscript(db *sql.DB, recordID int64, fileUniqueID string, transcript string) {
+	stmt := `UPDATE attachments SET transcript = ? WHERE record_id = ? AND file_unique_id = ?;`
+	if _, err := db.Exec(stmt, transcript, recordID, fileUniqueID); err != nil {
+		slog.Error("failed to store transcript", "recordID", recordID, "error", err)
+	}
+}
+
+// AttachmentKeys returns the unique file ids of every stored attachment.
+func AttachmentKeys(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT file_unique_id FROM attachments")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys[key] = true
 	}
+	return keys, rows.Err()
 }
 
-func DeleteLastChatRecord(db *sql.DB, sessionID int64) {
-	// Delete the record with the highest id for the user.
+// FindRecordByMessage returns the conversation and id of the record a Telegram message belongs to.
+func FindRecordByMessage(db *sql.DB, sessionID int64, chatID int64, messageID int) (conversationID int64, recordID int64, err error) {
+	err = db.QueryRow(`
+	SELECT chat_records.conversation_id, chat_records.id FROM record_messages
+	JOIN chat_records ON chat_records.id = record_messages.record_id
+	WHERE record_messages.chat_id = ? AND record_messages.message_id = ? AND chat_records.session_id = ?`,
+		chatID, messageID, sessionID).Scan(&conversationID, &recordID)
+	return
+}
+
+// LastRecordID returns the id of the latest record in a conversation.
+func LastRecordID(db *sql.DB, conversationID int64) (int64, error) {
+	var id sql.NullInt64
+	err := db.QueryRow("SELECT MAX(id) FROM chat_records WHERE conversation_id = ?", conversationID).Scan(&id)
+	return id.Int64, err
+}
+
+// ForkConversation copies a conversation up to and including a record into a new conversation of the session.
+func ForkConversation(db *sql.DB, sessionID int64, conversationID int64, recordID int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+	INSERT INTO conversations(session_id, title, summary, updated_at)
+	SELECT session_id, CASE WHEN title = '' THEN '' ELSE title || ' (fork)' END, summary, unixepoch()
+	FROM conversations WHERE id = ?;`, conversationID)
+	if err != nil {
+		return 0, err
+	}
+	forkID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`
+	SELECT id, role, content FROM chat_records
+	WHERE conversation_id = ? AND id <= ?
+	ORDER BY id ASC`, conversationID, recordID)
+	if err != nil {
+		return 0, err
+	}
+	var records []ChatRecord
+	for rows.Next() {
+		var record ChatRecord
+		if err := rows.Scan(&record.DBID, &record.Role, &record.Content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+
+	for _, record := range records {
+		res, err := tx.Exec("INSERT INTO chat_records(session_id, conversation_id, role, content) VALUES(?, ?, ?, ?);",
+			sessionID, forkID, record.Role, record.Content)
+		if err != nil {
+			return 0, err
+		}
+		copyID, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+		INSERT INTO attachments(record_id, kind, file_id, file_unique_id, transcript)
+		SELECT ?, kind, file_id, file_unique_id, transcript FROM attachments WHERE record_id = ? ORDER BY id ASC;`,
+			copyID, record.DBID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return forkID, tx.Commit()
+}
+
+func DeleteLastChatRecord(db *sql.DB, conversationID int64) {
+	// Delete the record with the highest id in the conversation.
 	stmt := `
 	DELETE FROM chat_records
 	WHERE id = (SELECT id FROM chat_records
-	            WHERE session_id = ?
+	            WHERE conversation_id = ?
 	            ORDER BY id DESC LIMIT 1);
 	`
-	if _, err := db.Exec(stmt, sessionID); err != nil {
-		slog.Error("failed to delete last chat record", "userID", sessionID, "error", err)
+	if _, err := db.Exec(stmt, conversationID); err != nil {
+		slog.Error("failed to delete last chat record", "conversationID", conversationID, "error", err)
 	}
 }
 
-type StoredSession struct {
-	Model       string
-	Temperature float32
-	Prompt      string
-	ChatRecords []ChatRecord
+type Conversation struct {
+	ID        int64
+	Title     string
+	UpdatedAt time.Time
 }
 
-func LoadSession(db *sql.DB, sessionID int64) (StoredSession, error) {
-	var ss StoredSession
-	row := db.QueryRow("SELECT model, temperature, prompt FROM sessions WHERE session_id = ?", sessionID)
-	var prompt sql.NullString
-	err := row.Scan(&ss.Model, &ss.Temperature, &prompt)
+// CreateConversation adds an empty conversation to a session and returns its id.
+func CreateConversation(db *sql.DB, sessionID int64) (int64, error) {
+	res, err := db.Exec("INSERT INTO conversations(session_id, updated_at) VALUES(?, unixepoch());", sessionID)
 	if err != nil {
-		return ss, err
+		return 0, err
 	}
-	if prompt.Valid {
-		ss.Prompt = prompt.String
-	} else {
-		ss.Prompt = ""
+	return res.LastInsertId()
+}
+
+// ListConversations returns the most recently updated conversations of a session.
+func ListConversations(db *sql.DB, sessionID int64, limit int) ([]Conversation, error) {
+	rows, err := db.Query(`
+	SELECT id, title, updated_at FROM conversations
+	WHERE session_id = ?
+	ORDER BY updated_at DESC, id DESC
+	LIMIT ?`, sessionID, limit)
+	if err != nil {
+		return nil, err
 	}
-	rows, err := db.Query("SELECT id, role, content FROM chat_records WHERE session_id = ? ORDER BY id ASC", sessionID)
+	defer rows.Close()
+	var conversations []Conversation
+	for rows.Next() {
+		var conversation Conversation
+		var updatedAt int64
+		if err := rows.Scan(&conversation.ID, &conversation.Title, &updatedAt); err != nil {
+			return nil, err
+		}
+		conversation.UpdatedAt = time.Unix(updatedAt, 0)
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// LoadConversation returns the summary and records of a conversation.
+func LoadConversation(db *sql.DB, conversationID int64) (summary string, records []ChatRecord, err error) {
+	err = db.QueryRow("SELECT summary FROM conversations WHERE id = ?", conversationID).Scan(&summary)
 	if err != nil {
-		return ss, err
+		return
+	}
+	rows, err := db.Query("SELECT id, role, content FROM chat_records WHERE conversation_id = ? ORDER BY id ASC", conversationID)
+	if err != nil {
+		return
 	}
 	defer rows.Close()
+	positions := make(map[int]int)
 	for rows.Next() {
 		var id int
 		var roleInt int
@@ -142,39 +388,139 @@ func LoadSession(db *sql.DB, sessionID int64) (StoredSession, error) {
 		if err := rows.Scan(&id, &roleInt, &content); err != nil {
 			continue
 		}
-		ss.ChatRecords = append(ss.ChatRecords, ChatRecord{DBID: id, Role: ChatRole(roleInt), Content: content})
+		positions[id] = len(records)
+		records = append(records, ChatRecord{DBID: id, Role: ChatRole(roleInt), Content: content})
+	}
+
+	messageRows, err := db.Query(`
+	SELECT record_messages.record_id, record_messages.message_id FROM record_messages
+	JOIN chat_records ON chat_records.id = record_messages.record_id
+	WHERE chat_records.conversation_id = ?
+	ORDER BY record_messages.message_id ASC`, conversationID)
+	if err != nil {
+		return
+	}
+	defer messageRows.Close()
+	for messageRows.Next() {
+		var recordID, messageID int
+		if err := messageRows.Scan(&recordID, &messageID); err != nil {
+			continue
+		}
+		if i, ok := positions[recordID]; ok {
+			records[i].MessageIDs = append(records[i].MessageIDs, messageID)
+		}
+	}
+
+	attachmentRows, err := db.Query(`
+	SELECT attachments.record_id, attachments.kind, attachments.file_id, attachments.file_unique_id,
+		COALESCE(attachments.transcript, '') FROM attachments
+	JOIN chat_records ON chat_records.id = attachments.record_id
+	WHERE chat_records.conversation_id = ?
+	ORDER BY attachments.id ASC`, conversationID)
+	if err != nil {
+		return
+	}
+	defer attachmentRows.Close()
+	for attachmentRows.Next() {
+		var recordID int
+		var attachment Attachment
+		if err := attachmentRows.Scan(&recordID, &attachment.Kind, &attachment.FileID, &attachment.FileUniqueID, &attachment.Transcript); err != nil {
+			continue
+		}
+		if i, ok := positions[recordID]; ok {
+			records[i].Attachments = append(records[i].Attachments, attachment)
+		}
+	}
+	return
+}
+
+func UpdateConversationTitle(db *sql.DB, conversationID int64, title string) {
+	stmt := `UPDATE conversations SET title = ? WHERE id = ?;`
+	if _, err := db.Exec(stmt, title, conversationID); err != nil {
+		slog.Error("failed to update conversation title", "conversationID", conversationID, "error", err)
+	}
+}
+
+func UpdateConversationSummary(db *sql.DB, conversationID int64, summary string) {
+	stmt := `UPDATE conversations SET summary = ? WHERE id = ?;`
+	if _, err := db.Exec(stmt, summary, conversationID); err != nil {
+		slog.Error("failed to update conversation summary", "conversationID", conversationID, "error", err)
+	}
+}
+
+func DeleteConversation(db *sql.DB, conversationID int64) {
+	stmt := `
+	DELETE FROM chat_records WHERE conversation_id = ?;
+	DELETE FROM conversations WHERE id = ?;
+	`
+	if _, err := db.Exec(stmt, conversationID, conversationID); err != nil {
+		slog.Error("failed to delete conversation", "conversationID", conversationID, "error", err)
 	}
-	return ss, nil
 }
 
-func ClearChatRecords(db *sql.DB, sessionID int64) {
-	stmt := `DELETE FROM chat_records WHERE session_id = ?;`
-	if _, err := db.Exec(stmt, sessionID); err != nil {
-		slog.Error("failed to clear chat records", "userID", sessionID, "error", err)
+func DeleteChatRecord(db *sql.DB, recordID int64) {
+	stmt := `DELETE FROM chat_records WHERE id = ?;`
+	if _, err := db.Exec(stmt, recordID); err != nil {
+		slog.Error("failed to delete chat record", "recordID", recordID, "error", err)
 	}
 }
 
+type StoredSession struct {
+	Model          string
+	Temperature    float32
+	Prompt         string
+	VoiceReplies   bool
+	ConversationID int64
+	Summary        string
+	ChatRecords    []ChatRecord
+}
+
+func LoadSession(db *sql.DB, sessionID int64) (StoredSession, error) {
+	var ss StoredSession
+	row := db.QueryRow("SELECT model, temperature, prompt, voice_replies, conversation_id FROM sessions WHERE session_id = ?", sessionID)
+	var prompt sql.NullString
+	var conversationID sql.NullInt64
+	err := row.Scan(&ss.Model, &ss.Temperature, &prompt, &ss.VoiceReplies, &conversationID)
+	if err != nil {
+		return ss, err
+	}
+	if prompt.Valid {
+		ss.Prompt = prompt.String
+	} else {
+		ss.Prompt = ""
+	}
+	if !conversationID.Valid {
+		return ss, nil
+	}
+	ss.ConversationID = conversationID.Int64
+	ss.Summary, ss.ChatRecords, err = LoadConversation(db, ss.ConversationID)
+	return ss, err
+}
+
 func ClearAllChatRecords(db *sql.DB) {
-	stmt := `DELETE FROM chat_records;`
+	stmt := `
+	DELETE FROM chat_records;
+	DELETE FROM conversations;
+	`
 	if _, err := db.Exec(stmt); err != nil {
 		slog.Error("failed to clear all chat records", "error", err)
 	}
 }
 
-func TrimOldChatRecords(db *sql.DB, sessionID int64, keepCount int) {
+func TrimOldChatRecords(db *sql.DB, conversationID int64, keepCount int) {
 	// Delete chat records except the most recent keepCount by id.
 	stmt := `
 	DELETE FROM chat_records
-	WHERE session_id = ?
+	WHERE conversation_id = ?
 	    AND id NOT IN (
 	        SELECT id FROM chat_records
-	        WHERE session_id = ?
+	        WHERE conversation_id = ?
 	        ORDER BY id DESC
 	        LIMIT ?
 	    );
 	`
-	if _, err := db.Exec(stmt, sessionID, sessionID, keepCount); err != nil {
-		slog.Error("failed to trim chat records", "sessionID", sessionID, "error", err)
+	if _, err := db.Exec(stmt, conversationID, conversationID, keepCount); err != nil {
+		slog.Error("failed to trim chat records", "conversationID", conversationID, "error", err)
 	}
 }
 
@@ -190,6 +536,9 @@ func TidyObsoleteSessions(db *sql.DB, validIDs []int64) (int, error) {
 		if _, err := tx.Exec("DELETE FROM chat_records"); err != nil {
 			return 0, err
 		}
+		if _, err := tx.Exec("DELETE FROM conversations"); err != nil {
+			return 0, err
+		}
 		res, err := tx.Exec("DELETE FROM sessions")
 		if err != nil {
 			return 0, err
@@ -209,6 +558,11 @@ func TidyObsoleteSessions(db *sql.DB, validIDs []int64) (int, error) {
 			return 0, err
 		}
 
+		convSQL := "DELETE FROM conversations WHERE session_id NOT IN (" + placeholders + ")"
+		if _, err := tx.Exec(convSQL, args...); err != nil {
+			return 0, err
+		}
+
 		sessSQL := "DELETE FROM sessions WHERE session_id NOT IN (" + placeholders + ")"
 		res, err := tx.Exec(sessSQL, args...)
 		if err != nil {
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func chatRecordsReferencesConversations(t *testing.T, db *sql.DB) bool {
+	t.Helper()
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_foreign_key_list('chat_records')
+		WHERE "table" = 'conversations' AND "from" = 'conversation_id'`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestOpenSessionDBSchema(t *testing.T) {
+	db := OpenSessionDB(t.TempDir())
+	defer db.Close()
+
+	if !chatRecordsReferencesConversations(t, db) {
+		t.Error("chat_records.conversation_id does not reference conversations")
+	}
+	conversationID, err := CreateConversation(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendChatRecord(db, 1, conversationID, int(RoleUser), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	_, records, err := LoadConversation(db, conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Content != "hello" {
+		t.Errorf("records = %+v, want the appended one", records)
+	}
+}
+
+// Databases from before conversations existed get the column and a conversation per session.
+func TestOpenSessionDBMigratesOldSchema(t *testing.T) {
+	dir := t.TempDir()
+	old, err := sql.Open("sqlite", "file:"+filepath.Join(dir, dataDbName)+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE sessions (session_id INTEGER PRIMARY KEY, model TEXT, temperature REAL);
+	CREATE TABLE chat_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER,
+		role INTEGER,
+		content TEXT,
+		FOREIGN KEY(session_id) REFERENCES sessions(session_id)
+	);
+	INSERT INTO sessions(session_id, model, temperature) VALUES (7, 'old', 0.5);
+	INSERT INTO chat_records(session_id, role, content) VALUES (7, 0, 'hi'), (7, 1, 'hello');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := OpenSessionDB(dir)
+	defer db.Close()
+	if !chatRecordsReferencesConversations(t, db) {
+		t.Error("migrated chat_records.conversation_id does not reference conversations")
+	}
+	stored, err := LoadSession(db, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ConversationID == 0 || len(stored.ChatRecords) != 2 {
+		t.Errorf("session = %+v, want both records in a conversation", stored)
+	}
+}
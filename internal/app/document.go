@@ -0,0 +1,50 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var errDocumentDownload = errors.New("download failed")
+
+// documentText reads an uploaded file into text for the user turn, headed by its name.
+// The returned error is meant to be shown to the user.
+func documentText(botState *State, doc *botapi.Document) (string, error) {
+	config := botState.Config
+	mimeType := util.DocumentMIMEType(doc.FileName, doc.MimeType)
+	if !util.MatchMIMEType(config.DocumentTypes, mimeType) {
+		return "", fmt.Errorf("unsupported file type %s", mimeType)
+	}
+	tooLarge := fmt.Errorf("file is larger than %d KiB", config.MaxDocumentSize>>10)
+	if doc.FileSize > config.MaxDocumentSize {
+		return "", tooLarge
+	}
+
+	data, err := util.DownloadFile(doc.FileID, botState.Bot)
+	if err != nil {
+		slog.Error("failed to download document", "error", err, "file_id", doc.FileID)
+		return "", errDocumentDownload
+	}
+	if len(data) > config.MaxDocumentSize {
+		return "", tooLarge
+	}
+	text, err := util.ExtractDocumentText(data, mimeType)
+	if err != nil {
+		slog.Warn("failed to read document", "error", err, "file_name", doc.FileName, "mime_type", mimeType)
+		return "", err
+	}
+
+	if runes := []rune(text); config.MaxDocumentLength > 0 && len(runes) > config.MaxDocumentLength {
+		text = string(runes[:config.MaxDocumentLength]) + "\n[truncated]"
+	}
+	name := doc.FileName
+	if name == "" {
+		name = "untitled"
+	}
+	return fmt.Sprintf("[File: %s]\n%s", name, text), nil
+}
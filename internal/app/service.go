@@ -6,50 +6,147 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rewired-gh/ichigo-bot/internal/util"
-	"github.com/sashabaranov/go-openai"
 
 	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// stoppedMarker is appended to replies cut short by the user, both on screen and in history.
+const stoppedMarker = "\n\n_(stopped)_"
+
+// failedMarker is appended to replies that could not be finished or shown in full.
+const failedMarker = "\n\n_(failed)_"
+
+// albumWindow is how long to wait for the remaining items of an album, even without debouncing.
+const albumWindow = time.Second
+
+var (
+	errResponseStopped  = errors.New("response stopped by user")
+	errResponseReplaced = errors.New("response replaced by an edited prompt")
+)
+
 // StartBotService initializes the bot state and update loop.
 func StartBotService(config *util.Config) {
 	slog.Info("initializing bot service")
 	botState := New(config)
-	bot, err := botapi.NewBotAPI(config.Token)
+	bot, err := util.NewTelegramMessenger(config.Token, config.Debug)
 	if err != nil {
 		slog.Error("failed to create bot API client", "error", err)
 		return
 	}
 
 	botState.Bot = bot
-	botState.Bot.Debug = config.Debug
-	slog.Info("bot API client initialized", "username", bot.Self.UserName, "debug_mode", config.Debug)
-	u := botapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := botState.Bot.GetUpdatesChan(u)
-	defer botState.Bot.StopReceivingUpdates()
+	defer bot.Stop()
+	Serve(botState)
+}
+
+// Serve processes updates from the bot transport until its update stream is closed.
+// Every session has its own worker, so sessions are served in parallel while the
+// updates of one session are handled in order.
+func Serve(botState *State) {
+	inboxes := make(map[int64]*inbox)
+	var workers sync.WaitGroup
+	for update := range botState.Bot.Updates() {
+		session, ok := findSession(botState, update)
+		if !ok {
+			continue
+		}
+		box, ok := inboxes[session.ID]
+		if !ok {
+			box = newInbox()
+			inboxes[session.ID] = box
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for {
+					update, ok := box.pop()
+					if !ok {
+						return
+					}
+					processUpdate(botState, session, update)
+				}
+			}()
+		}
+		box.push(update)
+	}
+
+	for _, box := range inboxes {
+		box.close()
+	}
+	workers.Wait()
+	botState.Responses.Wait()
+}
 
-	for update := range updates {
-		processUpdate(botState, update)
+// inbox queues the updates of one session. Pushing never blocks, so a session that is
+// stuck on a slow download does not hold up the dispatcher and with it every other session.
+type inbox struct {
+	mu      sync.Mutex
+	updates []botapi.Update
+	closed  bool
+	ready   chan struct{} // signalled when updates are pushed or the inbox is closed
+}
+
+func newInbox() *inbox {
+	return &inbox{ready: make(chan struct{}, 1)}
+}
+
+func (b *inbox) push(update botapi.Update) {
+	b.mu.Lock()
+	b.updates = append(b.updates, update)
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *inbox) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *inbox) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next update. It returns false once the inbox is closed and drained.
+func (b *inbox) pop() (botapi.Update, bool) {
+	for {
+		b.mu.Lock()
+		if len(b.updates) > 0 {
+			update := b.updates[0]
+			b.updates[0] = botapi.Update{}
+			b.updates = b.updates[1:]
+			b.mu.Unlock()
+			return update, true
+		}
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return botapi.Update{}, false
+		}
+		<-b.ready
 	}
 }
 
-// processUpdate processes a single update from Telegram.
-func processUpdate(botState *State, update botapi.Update) {
+// findSession returns the session an update belongs to, or false if the sender is not authorized.
+func findSession(botState *State, update botapi.Update) (*Session, bool) {
 	inMsg := update.Message
+	if inMsg == nil {
+		inMsg = update.EditedMessage
+	}
 	if inMsg == nil {
 		slog.Debug("skipping update with nil message", "update_id", update.UpdateID)
-		return
+		return nil, false
 	}
 
-	slog.Debug("processing update",
-		"update_id", update.UpdateID,
-		"user_id", inMsg.From.ID,
-		"chat_id", inMsg.Chat.ID,
-		"is_command", inMsg.IsCommand())
-
 	// Get user session via user id, fall back to chat id.
 	session, exists := botState.SessionMap[inMsg.From.ID]
 	if !exists {
@@ -60,55 +157,191 @@ func processUpdate(botState *State, update botapi.Update) {
 				"user_id", inMsg.From.ID,
 				"chat_id", chat.ID,
 				"username", inMsg.From.UserName)
-			return
+			return nil, false
+		}
+	}
+	return session, true
+}
+
+// processUpdate processes a single update from Telegram while holding the session lock.
+func processUpdate(botState *State, session *Session, update botapi.Update) {
+	if update.EditedMessage != nil {
+		session.Lock()
+		defer session.Unlock()
+		if update.EditedMessage.Chat.IsPrivate() && !util.IsCommand(update.EditedMessage) {
+			handleEditedMessage(botState, update.EditedMessage, session)
 		}
+		return
 	}
 
+	inMsg := update.Message
+	slog.Debug("processing update",
+		"update_id", update.UpdateID,
+		"user_id", inMsg.From.ID,
+		"chat_id", inMsg.Chat.ID,
+		"is_command", inMsg.IsCommand())
+
+	session.Lock()
+	defer session.Unlock()
 	if util.IsCommand(inMsg) {
 		handleCommand(botState, inMsg, session)
-	} else if inMsg.Chat.IsPrivate() {
+	} else if inMsg.Chat.IsPrivate() || inMsg.MediaGroupID != "" && inMsg.MediaGroupID == session.MediaGroupID {
+		// In groups, the rest of an album sent with /chat has no caption of its own.
 		handleChatAction(botState, inMsg, session)
 	}
 }
 
+// responseTurn is a snapshot of what a response needs from its session, taken under the session lock.
+type responseTurn struct {
+	epoch        int
+	models       []string // the session model followed by its fallbacks
+	temperature  float32
+	prompt       string
+	systemPrompt string
+	summary      string            // running summary, updated by the response if records were dropped
+	summarized   bool              // the dropped records were folded into summary
+	dropped      []ChatRecord      // records leaving the history, removed once their summary is stored
+	records      []ChatRecord      // the history sent with the request
+	inputs       []*botapi.Message // the user messages answered by this turn
+	outMessageID int               // existing bot message to answer in, if any
+	voiceReply   bool              // also read the response out, see Session.VoiceReplies
+	messageIDs   []int             // the bot messages the response was sent in
+	transcribed  bool              // audio of the prompt was transcribed into records
+	throttler    <-chan struct{}   // paces streamed edits, see Session.EditThrottler
+}
+
 // handleChatAction sends a user message to the AI and invokes response handling.
+// Messages arriving while responding are handled according to the queue policy.
 func handleChatAction(botState *State, inMsg *botapi.Message, session *Session) {
-	// Drain any pending response.
-	select {
-	case content := <-session.ResponseChannel:
-		session.ChatRecords = append(session.ChatRecords, ChatRecord{Role: RoleBot, Content: content})
-		session.State = StateIdle
-		AppendChatRecord(botState.DB, session.ID, int(RoleBot), content)
-	default:
-	}
+	// Telegram delivers every item of an album as its own message, so items after the first one
+	// join whatever happened to the first.
+	restOfAlbum := inMsg.MediaGroupID != "" && inMsg.MediaGroupID == session.MediaGroupID
+	session.MediaGroupID = inMsg.MediaGroupID
 
 	if session.State == StateResponding {
-		slog.Warn("ignoring new message while responding", "userID", inMsg.From.ID)
-		util.SendMessageQuick(inMsg.Chat.ID, "Last response has not completed yet.", botState.Bot)
+		switch botState.Config.QueuePolicy {
+		case util.QueuePolicyQueue, util.QueuePolicyMerge:
+			slog.Debug("queueing message while responding", "userID", inMsg.From.ID, "pending", len(session.Pending)+1)
+			session.Pending = append(session.Pending, inMsg)
+		case util.QueuePolicyInterrupt:
+			if !restOfAlbum {
+				slog.Info("interrupting response for new message", "userID", inMsg.From.ID)
+				tryStoppingResponse(session)
+			}
+			session.Pending = append(session.Pending, inMsg)
+		default:
+			if restOfAlbum {
+				slog.Debug("ignoring album item while responding", "userID", inMsg.From.ID, "media_group_id", inMsg.MediaGroupID)
+				return
+			}
+			slog.Warn("ignoring new message while responding", "userID", inMsg.From.ID)
+			util.SendMessageQuick(inMsg.Chat.ID, "Last response has not completed yet.", botState.Bot)
+		}
 		return
 	}
 
-	// Clear stale stop signal.
-	select {
-	case <-session.StopChannel:
-	default:
+	window := time.Duration(botState.Config.DebounceWindow) * time.Millisecond
+	if inMsg.MediaGroupID != "" || len(session.Pending) > 0 {
+		window = max(window, albumWindow)
+	}
+	if window > 0 {
+		// Gather quick successive messages and answer them as one turn once the session goes quiet.
+		session.Pending = append(session.Pending, inMsg)
+		session.DebounceSeq++
+		seq := session.DebounceSeq
+		botState.Responses.Add(1)
+		time.AfterFunc(window, func() {
+			defer botState.Responses.Done()
+			flushPending(botState, session, seq)
+		})
+		return
 	}
+	startTurn(botState, session, []*botapi.Message{inMsg}, 0, false)
+}
 
-	// Append this user message to the session.
-	session.ChatRecords = append(session.ChatRecords, ChatRecord{Role: RoleUser, Content: inMsg.Text})
-	session.State = StateResponding
-	AppendChatRecord(botState.DB, session.ID, int(RoleUser), inMsg.Text)
+// handleEditedMessage answers the latest prompt again after the user edited it, replacing the
+// reply in place. Edits of older messages, or of prompts gathered from several messages, are ignored.
+func handleEditedMessage(botState *State, inMsg *botapi.Message, session *Session) {
+	if session.Rerun != nil && session.Rerun.MessageID == inMsg.MessageID {
+		session.Rerun = inMsg
+		return
+	}
+	conversationID, recordID, err := FindRecordByMessage(botState.DB, session.ID, inMsg.Chat.ID, inMsg.MessageID)
+	if err != nil || conversationID != session.ConversationID {
+		slog.Debug("ignoring edit of message outside the current conversation", "message_id", inMsg.MessageID)
+		return
+	}
+	i := slices.IndexFunc(session.ChatRecords, func(record ChatRecord) bool { return record.DBID == int(recordID) })
+	if i < 0 || len(session.ChatRecords[i].MessageIDs) != 1 {
+		slog.Debug("ignoring edit of message that cannot be replayed", "message_id", inMsg.MessageID)
+		return
+	}
+	responding := session.State == StateResponding
+	if responding && i != len(session.ChatRecords)-1 ||
+		!responding && (i != len(session.ChatRecords)-2 || session.ChatRecords[i+1].Role != RoleBot) {
+		slog.Debug("ignoring edit of message that is not the latest prompt", "message_id", inMsg.MessageID)
+		return
+	}
+	slog.Info("answering edited prompt again", "user_id", inMsg.From.ID, "message_id", inMsg.MessageID)
+
+	if responding {
+		// The reply is replaced once the in-flight response has wound down.
+		session.CancelResponse(errResponseReplaced)
+		session.Epoch++
+		session.Rerun = inMsg
+		DeleteChatRecord(botState.DB, recordID)
+		session.ChatRecords = session.ChatRecords[:i]
+		return
+	}
 
-	// Handle the response asynchronously.
-	go handleResponse(botState, inMsg, session)
+	reply := session.ChatRecords[i+1]
+	DeleteChatRecord(botState.DB, int64(reply.DBID))
+	DeleteChatRecord(botState.DB, recordID)
+	session.ChatRecords = session.ChatRecords[:i]
+	startTurn(botState, session, []*botapi.Message{inMsg}, reuseReply(botState, inMsg.Chat.ID, reply.MessageIDs), true)
 }
 
-// handleResponse builds the OpenAI request and processes responses (streaming or non-streaming).
-func handleResponse(botState *State, inMsg *botapi.Message, session *Session) {
-	slog.Debug("preparing AI response",
-		"user_id", inMsg.From.ID,
-		"model", session.Model,
-		"records", len(session.ChatRecords))
+// reuseReply clears the bot messages of a replaced reply for the new one: the first is answered
+// in again and the rest are deleted, so no part of the old reply is left below the new one.
+// It returns the message to answer in, or 0 if there is none.
+func reuseReply(botState *State, chatID int64, messageIDs []int) int {
+	if len(messageIDs) == 0 {
+		return 0
+	}
+	for _, messageID := range messageIDs[1:] {
+		if err := botState.Bot.Delete(chatID, messageID); err != nil {
+			slog.Warn("failed to delete message of replaced reply", "message_id", messageID, "error", err)
+		}
+	}
+	return messageIDs[0]
+}
+
+// flushPending starts a turn with the gathered messages, unless more arrived after the timer seq was set.
+func flushPending(botState *State, session *Session, seq int) {
+	session.Lock()
+	defer session.Unlock()
+	if seq != session.DebounceSeq || session.State == StateResponding || len(session.Pending) == 0 {
+		return
+	}
+	next := session.Pending
+	session.Pending = nil
+	startTurn(botState, session, next, 0, false)
+}
+
+// startTurn appends the user messages to the session as one turn and starts responding to it.
+// The response is written into the bot message outMessageID, or a new message if it is 0.
+// A rerun answers an edited prompt again.
+func startTurn(botState *State, session *Session, inMsgs []*botapi.Message, outMessageID int, rerun bool) {
+	inMsg := inMsgs[len(inMsgs)-1]
+	// An edited prompt is answered again where it stands, its reply was followed the first time.
+	if !rerun {
+		for _, msg := range inMsgs {
+			if msg.ReplyToMessage != nil {
+				followReply(botState, session, msg)
+				break
+			}
+		}
+	}
 
 	model, ok := botState.CachedModelMap[session.Model]
 	if !ok {
@@ -116,19 +349,6 @@ func handleResponse(botState *State, inMsg *botapi.Message, session *Session) {
 		util.SendMessageQuick(inMsg.Chat.ID, "Model not configured.", botState.Bot)
 		return
 	}
-	client, ok := botState.CachedProviderMap[model.Provider]
-	if !ok {
-		slog.Error("provider not found", "provider", model.Provider)
-		util.SendMessageQuick(inMsg.Chat.ID, "Provider not found.", botState.Bot)
-		return
-	}
-
-	// Retain recent records if needed.
-	upperLimit := botState.Config.MaxChatRecordsPerUser - 2
-	if len(session.ChatRecords) > upperLimit {
-		session.ChatRecords = session.ChatRecords[len(session.ChatRecords)-upperLimit:]
-		TrimOldChatRecords(botState.DB, session.ID, upperLimit)
-	}
 
 	// Retain the system prompt
 	var systemPromptName string
@@ -139,6 +359,7 @@ func handleResponse(botState *State, inMsg *botapi.Message, session *Session) {
 	}
 	var systemPrompt string
 	if systemPromptName != "" {
+		var ok bool
 		systemPrompt, ok = botState.CachedPromptMap[systemPromptName]
 		if !ok {
 			slog.Error("system prompt not found", "prompt", systemPromptName)
@@ -148,240 +369,541 @@ func handleResponse(botState *State, inMsg *botapi.Message, session *Session) {
 		systemPrompt = util.FallbackSystemPromptString
 	}
 
-	// Build request messages.
-	var openaiMsgs []openai.ChatCompletionMessage
-	systemRole := openai.ChatMessageRoleSystem
-	if !model.SystemPrompt {
-		systemRole = util.ChatMessageRoleDeveloper
+	// Append the user messages to the session.
+	texts := make([]string, 0, len(inMsgs))
+	var attachments []Attachment
+	for _, msg := range inMsgs {
+		attachments = append(attachments, messageAttachments(msg)...)
+		text := msg.Text
+		if text == "" {
+			text = msg.Caption
+		}
+		if text != "" {
+			text = quotedContext(msg) + text
+			if sender := forwardedSender(msg); sender != "" {
+				text = fmt.Sprintf("[Forwarded from %s]\n%s", sender, text)
+			}
+			texts = append(texts, text)
+		}
+		if msg.Document != nil {
+			docText, err := documentText(botState, msg.Document)
+			if err != nil {
+				util.SendMessageQuick(msg.Chat.ID, fmt.Sprintf("Skipped %s: %s.", msg.Document.FileName, err), botState.Bot)
+				continue
+			}
+			texts = append(texts, docText)
+		}
+		if audio := messageAudio(msg); audio != nil {
+			// Transcribed by the response for the models that cannot hear it, see transcribeAudio.
+			attachments = append(attachments, *audio)
+		}
 	}
-	openaiMsgs = append(openaiMsgs, openai.ChatCompletionMessage{
-		Role:    systemRole,
-		Content: systemPrompt,
-	})
-	for _, record := range session.ChatRecords {
-		if record.Content == "" {
-			continue
+	content := strings.Join(texts, "\n\n")
+	if content == "" && len(attachments) == 0 {
+		slog.Debug("nothing to answer in messages", "count", len(inMsgs))
+		return
+	}
+	setConversationTitle(botState, session, content)
+	record := ChatRecord{Role: RoleUser, Content: content, MessageIDs: make([]int, 0, len(inMsgs)), Attachments: attachments}
+	for _, msg := range inMsgs {
+		record.MessageIDs = append(record.MessageIDs, msg.MessageID)
+	}
+	appendRecord(botState, session, inMsg.Chat.ID, record)
+	session.State = StateResponding
+
+	// Retain recent records if needed. Records to be summarized are only removed once the
+	// response has stored their summary, so that they are not lost if it never does.
+	var dropped []ChatRecord
+	if n := overflowingRecords(botState, session.ChatRecords, model, withSummary(systemPrompt, session.Summary)); n > 0 {
+		if botState.Config.SummaryModel != "" {
+			dropped = slices.Clone(session.ChatRecords[:n])
+		} else {
+			session.ChatRecords = session.ChatRecords[n:]
+			TrimOldChatRecords(botState.DB, session.ConversationID, len(session.ChatRecords))
 		}
-		openaiMsgs = append(openaiMsgs, record.ToOpenAIChatMessage())
 	}
 
-	// Retreive photos if exists.
-	photos := inMsg.Photo
-	if len(photos) > 0 && len(openaiMsgs) > 0 {
-		multiContent := make([]openai.ChatMessagePart, 0, len(photos)+1)
-		multiContent = append(multiContent, openai.ChatMessagePart{
-			Type: openai.ChatMessagePartTypeText,
-			Text: inMsg.Caption,
-		})
+	turn := responseTurn{
+		epoch:        session.Epoch,
+		models:       modelChain(botState, session),
+		temperature:  session.Temperature,
+		prompt:       session.Prompt,
+		systemPrompt: systemPrompt,
+		summary:      session.Summary,
+		dropped:      dropped,
+		records:      slices.Clone(session.ChatRecords[len(dropped):]),
+		inputs:       inMsgs,
+		outMessageID: outMessageID,
+		throttler:    session.EditThrottler,
+		voiceReply:   session.VoiceReplies && slices.ContainsFunc(inMsgs, func(msg *botapi.Message) bool { return msg.Voice != nil }),
+	}
 
-		photo := photos[len(photos)-1]
-		base64Image, err := handlePhoto(botState, photo)
-		if err != nil {
-			slog.Error("failed to retrieve photo", "error", err.Error(), "file_id", photo.FileID, "file_size", photo.FileSize)
-		} else {
-			multiContent = append(multiContent, openai.ChatMessagePart{
-				Type: openai.ChatMessagePartTypeImageURL,
-				ImageURL: &openai.ChatMessageImageURL{
-					URL: base64Image,
-				},
-			})
+	// Handle the response asynchronously.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	session.CancelResponse = cancel
+	botState.Responses.Add(1)
+	go func() {
+		defer botState.Responses.Done()
+		content := handleResponse(ctx, botState, inMsg, &turn)
+		finishResponse(botState, session, turn, content)
+		if turn.voiceReply && content != "" && ctx.Err() == nil {
+			if err := speak(botState, inMsg.Chat.ID, content); err != nil {
+				slog.Error("failed to speak response", "error", err)
+			}
 		}
+	}()
+}
 
-		lastMsg := openai.ChatCompletionMessage{
-			Role:         openai.ChatMessageRoleUser,
-			MultiContent: multiContent,
+// overflowingRecords counts the oldest records that have to leave the history before a turn.
+// If the model has a context window, the token budget decides, otherwise MaxChatRecordsPerUser does.
+// With summarization, half of the history is folded into the summary at once so that it is not
+// updated on every turn.
+func overflowingRecords(botState *State, records []ChatRecord, model *util.Model, systemPrompt string) int {
+	summarize := botState.Config.SummaryModel != ""
+	if model.ContextWindow <= 0 {
+		limit := botState.Config.MaxChatRecordsPerUser - 2
+		if len(records) <= limit {
+			return 0
 		}
-		openaiMsgs[len(openaiMsgs)-1] = lastMsg
+		if summarize {
+			return len(records) - max(limit/2, 1)
+		}
+		return len(records) - limit
 	}
 
-	slog.Debug("sending request to AI provider",
-		"provider", model.Provider,
-		"model_name", model.Name,
-		"messages", len(openaiMsgs),
-		"streaming", model.Stream)
-
-	req := openai.ChatCompletionRequest{
-		Messages:            openaiMsgs,
-		Model:               model.Name,
-		MaxCompletionTokens: botState.Config.MaxTokensPerResponse,
-		Stream:              model.Stream,
+	budget := model.ContextWindow - botState.Config.MaxTokensPerResponse - util.EstimateTokens(systemPrompt)
+	msgs := make([]util.ChatMessage, len(records))
+	for i := range records {
+		msgs[i] = records[i].ToChatMessage(nil)
 	}
+	kept := len(util.FitContext(msgs, budget))
+	if kept < len(records) && summarize {
+		kept = len(util.FitContext(msgs, budget/2))
+	}
+	return len(records) - kept
+}
 
-	if model.Temperature {
-		req.Temperature = session.Temperature
+// forwardedSender names the original sender of a forwarded message, or returns "" if it was not forwarded.
+func forwardedSender(msg *botapi.Message) string {
+	switch {
+	case msg.ForwardFrom != nil:
+		return strings.TrimSpace(msg.ForwardFrom.FirstName + " " + msg.ForwardFrom.LastName)
+	case msg.ForwardFromChat != nil:
+		return msg.ForwardFromChat.Title
+	case msg.ForwardSenderName != "":
+		return msg.ForwardSenderName
+	case msg.ForwardDate != 0:
+		return "unknown"
 	}
+	return ""
+}
 
-	if !model.Stream {
-		processNonStreamingResponse(botState, inMsg, session, client, req)
-	} else {
-		processStreamingResponse(botState, inMsg, session, client, req)
+// appendRecord adds a record to the current conversation, remembering the Telegram messages it was sent in.
+func appendRecord(botState *State, session *Session, chatID int64, record ChatRecord) {
+	id, err := AppendChatRecord(botState.DB, session.ID, session.ConversationID, int(record.Role), record.Content)
+	if err == nil {
+		record.DBID = int(id)
+		LinkRecordMessages(botState.DB, chatID, id, record.MessageIDs)
+		AddAttachments(botState.DB, id, record.Attachments)
 	}
+	session.ChatRecords = append(session.ChatRecords, record)
 }
 
-func handlePhoto(botState *State, photo botapi.PhotoSize) (base64Image string, err error) {
-	bytes, err := util.DownloadFile(photo.FileID, botState.Bot)
-	if err != nil {
-		return
+// finishResponse records a completed response, unless the history was reset in the meantime,
+// and moves on to the messages queued while it was generated.
+func finishResponse(botState *State, session *Session, turn responseTurn, content string) {
+	session.Lock()
+	defer session.Unlock()
+	session.State = StateIdle
+	session.CancelResponse = nil
+	if session.Epoch == turn.epoch {
+		chatID := turn.inputs[len(turn.inputs)-1].Chat.ID
+		if turn.transcribed {
+			storeTranscripts(botState, session, turn.records[len(turn.records)-1])
+		}
+		appendRecord(botState, session, chatID, ChatRecord{Role: RoleBot, Content: content, MessageIDs: turn.messageIDs})
+		if turn.summarized {
+			session.Summary = turn.summary
+			UpdateConversationSummary(botState.DB, session.ConversationID, session.Summary)
+			session.ChatRecords = session.ChatRecords[len(turn.dropped):]
+			TrimOldChatRecords(botState.DB, session.ConversationID, len(session.ChatRecords))
+		}
 	}
 
-	base64Image, err = util.EncodeImageToBase64(bytes)
-	if err != nil {
+	if rerun := session.Rerun; rerun != nil {
+		session.Rerun = nil
+		outMessageID := reuseReply(botState, rerun.Chat.ID, turn.messageIDs)
+		startTurn(botState, session, []*botapi.Message{rerun}, outMessageID, true)
+		return
+	}
+	if len(session.Pending) == 0 {
 		return
 	}
-	return
+	var next []*botapi.Message
+	if botState.Config.QueuePolicy == util.QueuePolicyMerge {
+		next, session.Pending = session.Pending, nil
+	} else {
+		n := albumLength(session.Pending)
+		next, session.Pending = session.Pending[:n], session.Pending[n:]
+	}
+	startTurn(botState, session, next, 0, false)
 }
 
-func processNonStreamingResponse(botState *State, inMsg *botapi.Message, session *Session, client *openai.Client, req openai.ChatCompletionRequest) {
-	req.Stream = false
-	responseContent := ""
-	defer func() {
-		session.ResponseChannel <- responseContent
-	}()
+// albumLength counts the leading messages that belong to the same album as the first one.
+func albumLength(msgs []*botapi.Message) int {
+	n := 1
+	if groupID := msgs[0].MediaGroupID; groupID != "" {
+		for n < len(msgs) && msgs[n].MediaGroupID == groupID {
+			n++
+		}
+	}
+	return n
+}
 
-	outMsg, err := util.SendMessageMarkdown(inMsg.Chat.ID, wrapMessage(true, responseContent, session), botState.Bot, botState.Config.UseTelegramify)
-	if err != nil {
-		slog.Error(err.Error())
-		return
+// handleResponse builds the chat request and processes responses (streaming or non-streaming),
+// moving on to the model's fallbacks when a model fails before producing any output.
+// Cancelling ctx with errResponseStopped aborts the request and keeps the partial text.
+// It returns the content to record for the bot's turn.
+func handleResponse(ctx context.Context, botState *State, inMsg *botapi.Message, turn *responseTurn) (responseContent string) {
+	slog.Debug("preparing AI response",
+		"user_id", inMsg.From.ID,
+		"model", turn.models[0],
+		"messages", len(turn.records))
+
+	if err := botState.Bot.SendChatAction(inMsg.Chat.ID, botapi.ChatTyping); err != nil {
+		slog.Warn("failed to send chat action", "error", err)
 	}
 
-	resp, err := client.CreateChatCompletion(context.Background(), req)
-	if err != nil {
-		slog.Error(err.Error())
-		util.SendMessageQuick(inMsg.Chat.ID, "Failed to generate response.", botState.Bot)
-		return
+	if len(turn.dropped) > 0 {
+		summary, err := summarizeHistory(ctx, botState, turn.summary, turn.dropped)
+		if err != nil {
+			slog.Error("failed to summarize history", "error", err, "model", botState.Config.SummaryModel)
+		} else {
+			turn.summary = summary
+			turn.summarized = true
+		}
+	}
+	systemPrompt := withSummary(turn.systemPrompt, turn.summary)
+
+	// Earlier images are sent again so that the model can still see them, within the image budget.
+	blobs := loadAttachments(botState, turn.records, botState.Config.MaxImagesPerRequest)
+
+	var outMsg botapi.Message
+	var err error
+	if turn.outMessageID != 0 {
+		outMsg = botapi.Message{MessageID: turn.outMessageID, Chat: inMsg.Chat}
+		util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(true, "", turn, turn.models[0]), botState.Bot, botState.Config.RenderMode())
+	} else {
+		outMsg, err = util.SendMessageMarkdown(inMsg.Chat.ID, wrapMessage(true, "", turn, turn.models[0]), botState.Bot, botState.Config.RenderMode())
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
 	}
-	responseContent = resp.Choices[0].Message.Content
-
-	if len(responseContent) > util.MessageCharacterLimit {
-		leftContent := responseContent[:util.MessageCharacterLimit]
-		rightContent := responseContent[util.MessageCharacterLimit:]
-		util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID,
-			wrapMessage(false, leftContent, session),
-			botState.Bot, botState.Config.UseTelegramify)
-
-		for len(rightContent) > 0 {
-			var chunk string
-			if len(rightContent) > util.MessageCharacterLimit {
-				chunk = rightContent[:util.MessageCharacterLimit]
-				rightContent = rightContent[util.MessageCharacterLimit:]
-			} else {
-				chunk = rightContent
-				rightContent = ""
+	turn.messageIDs = append(turn.messageIDs, outMsg.MessageID)
+
+	for i, alias := range turn.models {
+		model := botState.CachedModelMap[alias]
+		backend, ok := botState.CachedProviderMap[model.Provider]
+		if !ok {
+			slog.Error("provider not found", "provider", model.Provider, "model", alias)
+			continue
+		}
+		if i > 0 {
+			slog.Info("falling back to next model", "model", alias)
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(true, "", turn, alias), botState.Bot, botState.Config.RenderMode())
+		}
+
+		transcribeAudio(ctx, botState, turn, model, backend, blobs)
+		msgs := buildMessages(turn.records, blobs, model, backend)
+
+		// Fit the history into the context window, keeping room for the system prompt and the reply.
+		reqMsgs := msgs
+		if model.ContextWindow > 0 {
+			budget := model.ContextWindow - botState.Config.MaxTokensPerResponse - util.EstimateTokens(systemPrompt)
+			reqMsgs = util.FitContext(msgs, budget)
+			if len(reqMsgs) < len(msgs) {
+				slog.Debug("trimmed history to fit context window",
+					"model", alias,
+					"context_window", model.ContextWindow,
+					"dropped", len(msgs)-len(reqMsgs))
 			}
-			outMsg, err = util.SendMessageMarkdown(inMsg.Chat.ID,
-				wrapMessage(false, chunk, session),
-				botState.Bot, botState.Config.UseTelegramify)
-			if err != nil {
-				slog.Error(err.Error())
-				return
+		}
+
+		slog.Debug("sending request to AI provider",
+			"provider", model.Provider,
+			"model_name", model.Name,
+			"messages", len(reqMsgs),
+			"streaming", model.Stream)
+
+		req := util.ChatRequest{
+			Model:         model.Name,
+			API:           model.API,
+			SystemPrompt:  systemPrompt,
+			DeveloperRole: !model.SystemPrompt,
+			Messages:      reqMsgs,
+			MaxTokens:     botState.Config.MaxTokensPerResponse,
+		}
+
+		if model.Temperature {
+			req.Temperature = &turn.temperature
+		}
+
+		reqCtx, cancel := modelContext(ctx, model)
+		if !model.Stream {
+			responseContent, err = processNonStreamingResponse(reqCtx, botState, inMsg, turn, outMsg, alias, backend, req)
+		} else {
+			responseContent, err = processStreamingResponse(reqCtx, botState, inMsg, turn, outMsg, alias, backend, req)
+		}
+		cancel()
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			// Cancelled before any output, so there is no point in trying other models.
+			if isResponseStopped(ctx) {
+				util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, stoppedMarker, turn, alias), botState.Bot, botState.Config.RenderMode())
+				return stoppedMarker
 			}
+			return ""
 		}
-	} else {
-		util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID,
-			wrapMessage(false, responseContent, session),
-			botState.Bot, botState.Config.UseTelegramify)
+		slog.Error("failed to generate response", "error", err, "model", alias)
 	}
+	util.SendMessageQuick(inMsg.Chat.ID, "Failed to generate response.", botState.Bot)
+	return ""
 }
 
-func processStreamingResponse(botState *State, inMsg *botapi.Message, session *Session, client *openai.Client, req openai.ChatCompletionRequest) {
-	req.Stream = true
-	slog.Debug("starting streaming response",
-		"user_id", inMsg.From.ID,
-		"chat_id", inMsg.Chat.ID)
+// modelContext applies the retry policy and timeout of a model to requests made with the returned context.
+func modelContext(ctx context.Context, model *util.Model) (context.Context, context.CancelFunc) {
+	ctx = util.WithRetryPolicy(ctx, model.RetryPolicy())
+	if model.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(model.Timeout)*time.Second)
+	}
+	return ctx, func() {}
+}
 
-	responseContent := ""
-	currentContent := ""
-	defer func() {
-		session.ResponseChannel <- responseContent
-	}()
+// modelChain returns the session model followed by its fallbacks that are available to the session.
+func modelChain(botState *State, session *Session) []string {
+	chain := []string{session.Model}
+	for _, alias := range botState.CachedModelMap[session.Model].Fallbacks {
+		if _, ok := botState.CachedModelMap[alias]; !ok {
+			slog.Warn("fallback model not configured", "model", session.Model, "fallback", alias)
+			continue
+		}
+		if !session.AvailableModels.ContainsOne(alias) || slices.Contains(chain, alias) {
+			continue
+		}
+		chain = append(chain, alias)
+	}
+	return chain
+}
+
+// buildMessages converts records into request messages, with placeholders for attachments
+// the model cannot take.
+func buildMessages(records []ChatRecord, blobs map[string][]byte, model *util.Model, backend util.ChatBackend) []util.ChatMessage {
+	accepted := make(map[string][]byte, len(blobs))
+	for _, record := range records {
+		for _, attachment := range record.Attachments {
+			blob, ok := blobs[attachment.FileUniqueID]
+			if !ok {
+				continue
+			}
+			switch attachment.Kind {
+			case AttachmentImage:
+				if !model.TextOnly {
+					accepted[attachment.FileUniqueID] = blob
+				}
+			case AttachmentAudio:
+				if hearsAudio(model, backend, blob) {
+					accepted[attachment.FileUniqueID] = blob
+				}
+			}
+		}
+	}
+	msgs := make([]util.ChatMessage, 0, len(records))
+	for _, record := range records {
+		if record.Content == "" && len(record.Attachments) == 0 {
+			continue
+		}
+		msgs = append(msgs, record.ToChatMessage(accepted))
+	}
+	return msgs
+}
 
-	outMsg, err := util.SendMessageMarkdown(inMsg.Chat.ID, wrapMessage(true, responseContent, session), botState.Bot, botState.Config.UseTelegramify)
+// processNonStreamingResponse fills outMsg with a complete response.
+// It only returns an error if nothing has been shown to the user, so another model may be tried.
+func processNonStreamingResponse(ctx context.Context, botState *State, inMsg *botapi.Message, turn *responseTurn, outMsg botapi.Message, alias string, backend util.ChatBackend, req util.ChatRequest) (string, error) {
+	resp, err := backend.CreateChat(ctx, req)
+	if isResponseReplaced(ctx) {
+		return "", nil
+	}
+	if isResponseStopped(ctx) {
+		slog.Info("response generation stopped by user",
+			"user_id", inMsg.From.ID)
+		util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, stoppedMarker, turn, alias), botState.Bot, botState.Config.RenderMode())
+		return stoppedMarker, nil
+	}
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		return "", err
+	}
+	logResponseFinished(req, resp.FinishReason, resp.Usage)
+
+	chunks := util.SplitMarkdown(resp.Content, util.MessageCharacterLimit)
+	util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID,
+		wrapMessage(false, chunks[0], turn, alias),
+		botState.Bot, botState.Config.RenderMode())
+	for i, chunk := range chunks[1:] {
+		sent, err := util.SendMessageMarkdown(inMsg.Chat.ID,
+			wrapMessage(false, chunk, turn, alias),
+			botState.Bot, botState.Config.RenderMode())
+		if err != nil {
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID,
+				wrapMessage(false, chunks[i]+failedMarker, turn, alias),
+				botState.Bot, botState.Config.RenderMode())
+			return resp.Content + failedMarker, nil
+		}
+		outMsg = sent
+		turn.messageIDs = append(turn.messageIDs, sent.MessageID)
 	}
+	return resp.Content, nil
+}
+
+// processStreamingResponse streams a response into outMsg, continuing in new messages when it grows too long.
+// It only returns an error if the stream failed before any content arrived, so another model may be tried.
+func processStreamingResponse(ctx context.Context, botState *State, inMsg *botapi.Message, turn *responseTurn, outMsg botapi.Message, alias string, backend util.ChatBackend, req util.ChatRequest) (string, error) {
+	slog.Debug("starting streaming response",
+		"user_id", inMsg.From.ID,
+		"chat_id", inMsg.Chat.ID)
 
-	stream, err := client.CreateChatCompletionStream(context.Background(), req)
+	stream, err := backend.CreateChatStream(ctx, req)
 	if err != nil {
-		slog.Error("failed to create completion stream",
-			"error", err,
-			"model", req.Model)
-		util.SendMessageQuick(inMsg.Chat.ID, "Failed to generate response.", botState.Bot)
-		return
+		return "", err
 	}
 	defer stream.Close()
 
+	responseContent := ""
+	currentContent := ""
+	finishReason := ""
+	var usage *util.ChatUsage
 	for {
-		select {
-		case <-session.StopChannel:
+		delta, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			logResponseFinished(req, finishReason, usage)
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, currentContent, turn, alias), botState.Bot, botState.Config.RenderMode())
+			return responseContent, nil
+		}
+		if isResponseReplaced(ctx) {
+			return "", nil
+		}
+		if isResponseStopped(ctx) {
 			slog.Info("response generation stopped by user",
 				"user_id", inMsg.From.ID)
-			return
-		default:
-			resp, err := stream.Recv()
-			if errors.Is(err, io.EOF) {
-				util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, currentContent, session), botState.Bot, botState.Config.UseTelegramify)
-				return
-			}
-			if err != nil {
-				slog.Error(err.Error())
-				util.SendMessageQuick(inMsg.Chat.ID, "Failed to generate response.", botState.Bot)
-				return
-			}
-			if len(resp.Choices) == 0 {
-				slog.Warn("Empty response")
-				continue
+			currentContent = util.BalanceMarkdown(currentContent) + stoppedMarker
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, currentContent, turn, alias), botState.Bot, botState.Config.RenderMode())
+			return util.BalanceMarkdown(responseContent) + stoppedMarker, nil
+		}
+		if err != nil {
+			if responseContent == "" {
+				return "", err
 			}
-			deltaContent := resp.Choices[0].Delta.Content
-			responseContent += deltaContent
-			currentContent += deltaContent
-
-			if len(currentContent) > util.MessageCharacterLimit {
-				chunk := currentContent[:util.MessageCharacterLimit]
-				currentContent = currentContent[util.MessageCharacterLimit:]
-				util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, chunk, session), botState.Bot, botState.Config.UseTelegramify)
-				outMsg, err = util.SendMessageMarkdown(inMsg.Chat.ID, wrapMessage(true, currentContent, session), botState.Bot, botState.Config.UseTelegramify)
-				if err != nil {
-					slog.Error(err.Error())
-					return
+			slog.Error(err.Error())
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, util.BalanceMarkdown(currentContent)+failedMarker, turn, alias), botState.Bot, botState.Config.RenderMode())
+			util.SendMessageQuick(inMsg.Chat.ID, "Failed to generate response.", botState.Bot)
+			return util.BalanceMarkdown(responseContent) + failedMarker, nil
+		}
+		if delta.FinishReason != "" {
+			finishReason = delta.FinishReason
+		}
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+		if delta.Content == "" {
+			continue
+		}
+		responseContent += delta.Content
+		currentContent += delta.Content
+
+		// Rendering is only needed once the raw content gets anywhere near the limit.
+		var chunks []string
+		if util.UTF16Len(currentContent) > util.MessageCharacterLimit/2 {
+			chunks = util.SplitMarkdown(currentContent, util.MessageCharacterLimit)
+		}
+		if len(chunks) > 1 {
+			util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, chunks[0], turn, alias), botState.Bot, botState.Config.RenderMode())
+			for i, chunk := range chunks[1:] {
+				// The last chunk is still being streamed into.
+				isTail := i == len(chunks)-2
+				if isTail {
+					chunk = util.BalanceMarkdown(chunk)
 				}
-			} else {
-				select {
-				case <-botState.EditThrottler:
-					util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(true, currentContent, session), botState.Bot, botState.Config.UseTelegramify)
-				default:
+				sent, err := util.SendMessageMarkdown(inMsg.Chat.ID, wrapMessage(isTail, chunk, turn, alias), botState.Bot, botState.Config.RenderMode())
+				if err != nil {
+					// The stream is abandoned, as the rest of it could not be shown either.
+					util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(false, chunks[i]+failedMarker, turn, alias), botState.Bot, botState.Config.RenderMode())
+					return util.BalanceMarkdown(responseContent) + failedMarker, nil
 				}
+				outMsg = sent
+				turn.messageIDs = append(turn.messageIDs, sent.MessageID)
+			}
+			currentContent = chunks[len(chunks)-1]
+		} else {
+			select {
+			case <-turn.throttler:
+				util.EditMessageMarkdown(outMsg.Chat.ID, outMsg.MessageID, wrapMessage(true, util.BalanceMarkdown(currentContent), turn, alias), botState.Bot, botState.Config.RenderMode())
+			default:
 			}
 		}
 	}
 }
 
-// wrapMessage adds a header banner to show the model and status.
-func wrapMessage(isResponding bool, content string, session *Session) string {
+func logResponseFinished(req util.ChatRequest, finishReason string, usage *util.ChatUsage) {
+	args := []any{"model_name", req.Model, "finish_reason", finishReason}
+	if usage != nil {
+		args = append(args, "prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens)
+	}
+	if finishReason == "length" {
+		slog.Warn("response truncated by token limit", args...)
+	} else {
+		slog.Debug("response finished", args...)
+	}
+}
+
+// wrapMessage adds a header banner to show the answering model and status.
+func wrapMessage(isResponding bool, content string, turn *responseTurn, modelAlias string) string {
 	systemPromptField := ""
-	if session.Prompt != "" {
-		systemPromptField = fmt.Sprintf(", p: %s", session.Prompt)
+	if turn.prompt != "" {
+		systemPromptField = fmt.Sprintf(", p: %s", turn.prompt)
 	}
 
 	var banner string
 	if isResponding {
-		banner = fmt.Sprintf("💭 *%s* (t: %.2f%s)\n\n", session.Model, session.Temperature, systemPromptField)
+		banner = fmt.Sprintf("💭 *%s* (t: %.2f%s)\n\n", modelAlias, turn.temperature, systemPromptField)
 	} else {
-		banner = fmt.Sprintf("🤗 *%s* (t: %.2f%s)\n\n", session.Model, session.Temperature, systemPromptField)
+		banner = fmt.Sprintf("🤗 *%s* (t: %.2f%s)\n\n", modelAlias, turn.temperature, systemPromptField)
 	}
 	return banner + content
 }
 
+// tryStoppingResponse cancels the in-flight response, which is still recorded with what it has so far,
+// and drops any queued messages and edits.
 func tryStoppingResponse(session *Session) {
-	if session.State == StateResponding {
-		go func() { session.StopChannel <- struct{}{} }()
-		session.State = StateIdle
+	if session.CancelResponse != nil {
+		session.CancelResponse(errResponseStopped)
 	}
+	session.Pending = nil
+	session.Rerun = nil
 }
 
-func tryDrainingResponseChannel(session *Session) {
-	select {
-	case <-session.ResponseChannel:
-	default:
-	}
+// discardResponse cancels the in-flight response and keeps it out of the history.
+func discardResponse(session *Session) {
+	tryStoppingResponse(session)
+	session.Epoch++
+}
+
+func isResponseStopped(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errResponseStopped)
+}
+
+func isResponseReplaced(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errResponseReplaced)
 }
@@ -0,0 +1,599 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const testModel = "stub"
+
+// stubBackend answers every request by echoing the latest user text.
+type stubBackend struct {
+	mu       sync.Mutex
+	requests []util.ChatRequest
+	delay    time.Duration
+}
+
+func (b *stubBackend) reply(ctx context.Context, req util.ChatRequest) (string, error) {
+	b.mu.Lock()
+	b.requests = append(b.requests, req)
+	b.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(b.delay):
+	}
+	last := req.Messages[len(req.Messages)-1]
+	return "echo: " + last.Parts[0].Text, nil
+}
+
+func (b *stubBackend) Requests() []util.ChatRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]util.ChatRequest(nil), b.requests...)
+}
+
+func (b *stubBackend) CreateChat(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	content, err := b.reply(ctx, req)
+	return util.ChatResponse{Content: content, FinishReason: "stop"}, err
+}
+
+func (b *stubBackend) CreateChatStream(ctx context.Context, req util.ChatRequest) (util.ChatStream, error) {
+	content, err := b.reply(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &stubStream{deltas: strings.SplitAfter(content, " ")}, nil
+}
+
+func (b *stubBackend) Transcribe(ctx context.Context, model string, fileName string, audio []byte) (string, error) {
+	return "heard " + string(audio), nil
+}
+
+type stubStream struct {
+	deltas []string
+}
+
+func (s *stubStream) Recv() (util.ChatDelta, error) {
+	if len(s.deltas) == 0 {
+		return util.ChatDelta{}, io.EOF
+	}
+	delta := s.deltas[0]
+	s.deltas = s.deltas[1:]
+	return util.ChatDelta{Content: delta}, nil
+}
+
+func (s *stubStream) Close() error {
+	return nil
+}
+
+func testConfig(users ...int64) *util.Config {
+	return &util.Config{
+		Users:                 users,
+		Models:                []util.Model{{Alias: testModel, Name: "stub-model", Provider: testModel, Stream: true}},
+		DefaultModel:          testModel,
+		MaxTokensPerResponse:  100,
+		MaxChatRecordsPerUser: 1000,
+		QueuePolicy:           util.QueuePolicyQueue,
+	}
+}
+
+// newTestState builds the bot state on a temporary data directory, answering with backend.
+func newTestState(t *testing.T, config *util.Config, backend util.ChatBackend) (*State, *util.MemoryMessenger) {
+	t.Helper()
+	t.Setenv("ICHIGOD_DATA_DIR", t.TempDir())
+	botState := New(config)
+	t.Cleanup(func() { botState.DB.Close() })
+	botState.CachedProviderMap[testModel] = backend
+	bot := util.NewMemoryMessenger()
+	botState.Bot = bot
+	return botState, bot
+}
+
+func textUpdate(userID int64, messageID int, text string) botapi.Update {
+	msg := &botapi.Message{
+		MessageID: messageID,
+		From:      &botapi.User{ID: userID},
+		Chat:      &botapi.Chat{ID: userID, Type: "private"},
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		msg.Entities = []botapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return botapi.Update{Message: msg}
+}
+
+// serve runs Serve until every pushed update has been handled and all responses are done.
+func serve(t *testing.T, botState *State, bot *util.MemoryMessenger, push func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		Serve(botState)
+		close(done)
+	}()
+	push()
+	bot.Stop()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Serve did not finish, sessions are probably deadlocked")
+	}
+}
+
+func TestServeConcurrentSessions(t *testing.T) {
+	const sessions, turns = 8, 5
+	users := make([]int64, sessions)
+	for i := range users {
+		users[i] = int64(1000 + i)
+	}
+	backend := &stubBackend{delay: time.Millisecond}
+	botState, bot := newTestState(t, testConfig(users...), backend)
+
+	serve(t, botState, bot, func() {
+		var wg sync.WaitGroup
+		var pushMu sync.Mutex
+		for _, user := range users {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for turn := range turns {
+					pushMu.Lock()
+					bot.Push(textUpdate(user, turn+1, fmt.Sprintf("user %d turn %d", user, turn)))
+					pushMu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	for _, user := range users {
+		session := botState.SessionMap[user]
+		if got := len(session.ChatRecords); got != 2*turns {
+			t.Fatalf("session %d has %d records, want %d", user, got, 2*turns)
+		}
+		for turn := range turns {
+			prompt := fmt.Sprintf("user %d turn %d", user, turn)
+			if got := session.ChatRecords[2*turn].Content; got != prompt {
+				t.Errorf("session %d record %d = %q, want %q", user, 2*turn, got, prompt)
+			}
+			if got := session.ChatRecords[2*turn+1].Content; got != "echo: "+prompt {
+				t.Errorf("session %d record %d = %q, want %q", user, 2*turn+1, got, "echo: "+prompt)
+			}
+		}
+		stored, err := LoadSession(botState.DB, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.ChatRecords) != 2*turns {
+			t.Errorf("session %d has %d stored records, want %d", user, len(stored.ChatRecords), 2*turns)
+		}
+	}
+	if got := len(backend.Requests()); got != sessions*turns {
+		t.Errorf("backend got %d requests, want %d", got, sessions*turns)
+	}
+}
+
+// Admins clearing at the same time used to wait for each other's session lock forever.
+func TestServeConcurrentClear(t *testing.T) {
+	config := testConfig(3, 4)
+	config.Admins = []int64{1, 2}
+	botState, bot := newTestState(t, config, &stubBackend{})
+
+	serve(t, botState, bot, func() {
+		for i := range 20 {
+			bot.Push(textUpdate(1, i+1, "/clear"))
+			bot.Push(textUpdate(2, i+1, "/clear"))
+			bot.Push(textUpdate(3, i+1, "hello"))
+		}
+	})
+
+	cleared := 0
+	for _, msg := range bot.Messages() {
+		if msg.Text == "All session data has been reset." {
+			cleared++
+		}
+	}
+	if cleared != 40 {
+		t.Errorf("got %d clear confirmations, want 40", cleared)
+	}
+}
+
+func recordCount(session *Session) int {
+	session.Lock()
+	defer session.Unlock()
+	return len(session.ChatRecords)
+}
+
+// blockingMessenger holds file downloads until release is closed.
+type blockingMessenger struct {
+	*util.MemoryMessenger
+	release chan struct{}
+}
+
+func (m *blockingMessenger) DownloadFile(fileID string) ([]byte, error) {
+	<-m.release
+	return m.MemoryMessenger.DownloadFile(fileID)
+}
+
+// A session stuck on a download must not hold up the updates of other sessions.
+func TestServeSlowSessionDoesNotBlockOthers(t *testing.T) {
+	config := testConfig(1, 2)
+	config.DocumentTypes = []string{"text/*"}
+	config.MaxDocumentSize = 1 << 20
+	botState, bot := newTestState(t, config, &stubBackend{})
+	blocking := &blockingMessenger{MemoryMessenger: bot, release: make(chan struct{})}
+	botState.Bot = blocking
+	bot.AddFile("notes", []byte("some notes"))
+
+	serve(t, botState, bot, func() {
+		// The updates are pushed in the background, since a stalled dispatcher stops taking them.
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			doc := textUpdate(1, 1, "")
+			doc.Message.Document = &botapi.Document{FileID: "notes", FileName: "notes.txt", MimeType: "text/plain"}
+			bot.Push(doc)
+			for i := range 100 {
+				bot.Push(textUpdate(1, i+2, "waiting"))
+			}
+			bot.Push(textUpdate(2, 1, "hello"))
+		}()
+
+		deadline := time.After(10 * time.Second)
+		for recordCount(botState.SessionMap[2]) < 2 {
+			select {
+			case <-deadline:
+				t.Error("other session was not answered while a download was stuck")
+				close(blocking.release)
+				<-pushed
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		close(blocking.release)
+		<-pushed
+	})
+}
+
+func TestContextWindowDecidesHistory(t *testing.T) {
+	const turns = 6
+	tests := []struct {
+		name          string
+		contextWindow int
+		wantSent      int // messages in the last request
+	}{
+		{"record cap without context window", 0, 2},
+		{"large context window", 100000, 2*turns - 1},
+		// A prompt takes 6 tokens and a reply 7, and 25 are left after the reserved response tokens.
+		{"small context window", 125, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(1)
+			config.MaxChatRecordsPerUser = 4
+			config.Models[0].ContextWindow = tt.contextWindow
+			config.Prompts = []util.Prompt{{Name: "empty"}}
+			config.DefaultSystemPrompt = "empty"
+			backend := &stubBackend{}
+			botState, bot := newTestState(t, config, backend)
+
+			serve(t, botState, bot, func() {
+				for i := range turns {
+					bot.Push(textUpdate(1, i+1, fmt.Sprintf("turn %d", i)))
+				}
+			})
+
+			requests := backend.Requests()
+			if got := len(requests[len(requests)-1].Messages); got != tt.wantSent {
+				t.Errorf("last request had %d messages, want %d", got, tt.wantSent)
+			}
+			session := botState.SessionMap[1]
+			if got := len(session.ChatRecords); got != tt.wantSent+1 {
+				t.Errorf("session has %d records, want %d", got, tt.wantSent+1)
+			}
+			stored, err := LoadSession(botState.DB, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(stored.ChatRecords); got != tt.wantSent+1 {
+				t.Errorf("session has %d stored records, want %d", got, tt.wantSent+1)
+			}
+		})
+	}
+}
+
+// failingSummaryBackend answers chats like stubBackend but fails every summary request.
+type failingSummaryBackend struct {
+	*stubBackend
+}
+
+func (b failingSummaryBackend) CreateChat(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	if req.SystemPrompt == summaryInstruction {
+		return util.ChatResponse{}, errors.New("summary model unavailable")
+	}
+	return b.stubBackend.CreateChat(ctx, req)
+}
+
+func TestSummarizedRecordsTrimmedAfterSummaryStored(t *testing.T) {
+	const turns = 4
+	tests := []struct {
+		name        string
+		failing     bool
+		wantRecords int
+	}{
+		// The first three records are summarized with the third turn.
+		{"summary stored", false, 2*turns - 3},
+		{"summary failed", true, 2 * turns},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(1)
+			config.MaxChatRecordsPerUser = 6
+			config.SummaryModel = testModel
+			var backend util.ChatBackend = &stubBackend{}
+			if tt.failing {
+				backend = failingSummaryBackend{&stubBackend{}}
+			}
+			botState, bot := newTestState(t, config, backend)
+
+			serve(t, botState, bot, func() {
+				for i := range turns {
+					bot.Push(textUpdate(1, i+1, fmt.Sprintf("turn %d", i)))
+				}
+			})
+
+			session := botState.SessionMap[1]
+			if got := len(session.ChatRecords); got != tt.wantRecords {
+				t.Errorf("session has %d records, want %d", got, tt.wantRecords)
+			}
+			if got := session.ChatRecords[len(session.ChatRecords)-1].Content; got != "echo: turn 3" {
+				t.Errorf("last record = %q, want the last reply", got)
+			}
+			stored, err := LoadSession(botState.DB, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(stored.ChatRecords); got != tt.wantRecords {
+				t.Errorf("session has %d stored records, want %d", got, tt.wantRecords)
+			}
+			if hasSummary := stored.Summary != ""; hasSummary == tt.failing || session.Summary != stored.Summary {
+				t.Errorf("summary = %q, stored %q, want one only if summarizing succeeded", session.Summary, stored.Summary)
+			}
+		})
+	}
+}
+
+// waitForRecords waits until the session has n records and is idle.
+func waitForRecords(t *testing.T, session *Session, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		session.Lock()
+		done := len(session.ChatRecords) == n && session.State == StateIdle
+		session.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session did not reach %d records", n)
+}
+
+// Editing a prompt that replies to an older bot message answers it again in the same branch.
+func TestEditedReplyDoesNotForkAgain(t *testing.T) {
+	botState, bot := newTestState(t, testConfig(1), &stubBackend{})
+	session := botState.SessionMap[1]
+
+	serve(t, botState, bot, func() {
+		bot.Push(textUpdate(1, 101, "first"))
+		waitForRecords(t, session, 2)
+		firstReply := bot.Messages()[len(bot.Messages())-1]
+		bot.Push(textUpdate(1, 102, "second"))
+		waitForRecords(t, session, 4)
+
+		reply := textUpdate(1, 103, "again")
+		reply.Message.ReplyToMessage = &firstReply
+		bot.Push(reply)
+		waitForRecords(t, session, 4)
+
+		edited := *reply.Message
+		edited.Text = "again, edited"
+		bot.Push(botapi.Update{EditedMessage: &edited})
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			session.Lock()
+			done := len(session.ChatRecords) == 4 && session.State == StateIdle &&
+				session.ChatRecords[2].Content == edited.Text && session.ChatRecords[3].Content == "echo: "+edited.Text
+			session.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("edited prompt was not answered again")
+	})
+
+	conversations, err := ListConversations(botState.DB, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 2 {
+		t.Errorf("got %d conversations, want the original and one branch", len(conversations))
+	}
+	forks := 0
+	for _, msg := range bot.Messages() {
+		if strings.HasPrefix(msg.Text, "Continuing from the replied message") {
+			forks++
+		}
+	}
+	if forks != 1 {
+		t.Errorf("got %d fork notices, want 1", forks)
+	}
+}
+
+// Editing a prompt whose reply was split into several messages leaves no part of the old reply.
+func TestEditedPromptReplacesSplitReply(t *testing.T) {
+	botState, bot := newTestState(t, testConfig(1), &stubBackend{})
+	session := botState.SessionMap[1]
+
+	serve(t, botState, bot, func() {
+		// Telegram numbers the messages of both sides together, so the prompt stays clear of the bot's IDs.
+		prompt := textUpdate(1, 1001, strings.Repeat("word ", 1000))
+		bot.Push(prompt)
+		waitForRecords(t, session, 2)
+		if n := len(bot.Messages()); n != 2 {
+			t.Fatalf("long reply was sent in %d messages, want 2", n)
+		}
+
+		edited := *prompt.Message
+		edited.Text = "short"
+		bot.Push(botapi.Update{EditedMessage: &edited})
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			session.Lock()
+			done := len(session.ChatRecords) == 2 && session.State == StateIdle && session.ChatRecords[1].Content == "echo: short"
+			session.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("edited prompt was not answered again")
+	})
+
+	messages := bot.Messages()
+	if len(messages) != 1 || !strings.HasSuffix(messages[0].Text, "echo: short") {
+		t.Errorf("bot messages = %+v, want only the new reply", messages)
+	}
+	if ids := botState.SessionMap[1].ChatRecords[1].MessageIDs; len(ids) != 1 || ids[0] != messages[0].MessageID {
+		t.Errorf("reply message IDs = %v, want the reused message", ids)
+	}
+}
+
+// Audio the backend cannot take is transcribed even for models marked as taking audio,
+// so that the user turn is never left empty.
+func TestVoiceTranscribedUnlessBackendAcceptsAudio(t *testing.T) {
+	config := testConfig(1)
+	config.Models[0].AudioInput = true
+	config.TranscriptionModel = testModel
+	backend := &stubBackend{}
+	botState, bot := newTestState(t, config, backend)
+	bot.AddFile("voice", []byte("OggS voice"))
+
+	serve(t, botState, bot, func() {
+		voice := textUpdate(1, 1, "")
+		voice.Message.Voice = &botapi.Voice{FileID: "voice", FileUniqueID: "voice-unique"}
+		bot.Push(voice)
+	})
+
+	session := botState.SessionMap[1]
+	if len(session.ChatRecords) != 2 {
+		t.Fatalf("session has %d records, want 2", len(session.ChatRecords))
+	}
+	record := session.ChatRecords[0]
+	if len(record.Attachments) != 1 || record.Attachments[0].Transcript != "heard OggS voice" {
+		t.Errorf("user record = %+v, want the audio with its transcript", record)
+	}
+	if got := session.ChatRecords[1].Content; got != "echo: heard OggS voice" {
+		t.Errorf("reply = %q, want an answer to the transcript", got)
+	}
+	stored, err := LoadSession(botState.DB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachments := stored.ChatRecords[0].Attachments; len(attachments) != 1 || attachments[0].Transcript != "heard OggS voice" {
+		t.Errorf("stored attachments = %+v, want the transcript kept", attachments)
+	}
+}
+
+// A fallback that cannot hear audio gets a transcript, even though the first model heard it.
+func TestVoiceTranscribedForFallback(t *testing.T) {
+	const wav = "RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00"
+	var audioRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), "input_audio") {
+			audioRequests.Add(1)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	primary, err := util.NewChatBackend(util.Provider{Name: testModel, Type: util.ProviderTypeOpenAI, BaseURL: server.URL, APIKey: "test-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(1)
+	config.Models[0].AudioInput = true
+	config.Models[0].Fallbacks = []string{"backup"}
+	config.Models = append(config.Models, util.Model{Alias: "backup", Name: "backup-model", Provider: "backup", Stream: true})
+	config.TranscriptionModel = "backup"
+	botState, bot := newTestState(t, config, primary)
+	botState.CachedProviderMap["backup"] = &stubBackend{}
+	bot.AddFile("voice", []byte(wav))
+
+	serve(t, botState, bot, func() {
+		voice := textUpdate(1, 1001, "")
+		voice.Message.Voice = &botapi.Voice{FileID: "voice", FileUniqueID: "voice-unique"}
+		bot.Push(voice)
+	})
+
+	if audioRequests.Load() == 0 {
+		t.Error("the first model was not sent the audio")
+	}
+	session := botState.SessionMap[1]
+	if len(session.ChatRecords) != 2 {
+		t.Fatalf("session has %d records, want 2", len(session.ChatRecords))
+	}
+	if got := session.ChatRecords[1].Content; got != "echo: heard "+wav {
+		t.Errorf("reply = %q, want the fallback to answer the transcript", got)
+	}
+}
+
+// unavailableBackend fails every request, like a provider that is down.
+type unavailableBackend struct{}
+
+func (unavailableBackend) CreateChat(ctx context.Context, req util.ChatRequest) (util.ChatResponse, error) {
+	return util.ChatResponse{}, errors.New("provider unavailable")
+}
+
+func (unavailableBackend) CreateChatStream(ctx context.Context, req util.ChatRequest) (util.ChatStream, error) {
+	return nil, errors.New("provider unavailable")
+}
+
+func TestFailingModelFallsBack(t *testing.T) {
+	config := testConfig(1)
+	config.Models[0].Fallbacks = []string{"backup"}
+	config.Models = append(config.Models, util.Model{Alias: "backup", Name: "backup-model", Provider: "backup", Stream: true})
+	botState, bot := newTestState(t, config, unavailableBackend{})
+	botState.CachedProviderMap["backup"] = &stubBackend{}
+
+	serve(t, botState, bot, func() {
+		bot.Push(textUpdate(1, 1, "hello"))
+	})
+
+	session := botState.SessionMap[1]
+	if len(session.ChatRecords) != 2 || session.ChatRecords[1].Content != "echo: hello" {
+		t.Fatalf("records = %+v, want the fallback's reply", session.ChatRecords)
+	}
+	messages := bot.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("bot sent %d messages, want the reply only", len(messages))
+	}
+	if text := messages[0].Text; !strings.HasPrefix(text, "🤗 *backup*") || strings.Contains(text, "*"+testModel+"*") {
+		t.Errorf("reply = %q, want the banner of the fallback model", text)
+	}
+}
@@ -1,13 +1,14 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
+	"sync"
 
 	mapset "github.com/deckarep/golang-set/v2"
 	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rewired-gh/ichigo-bot/internal/util"
-	"github.com/sashabaranov/go-openai"
 )
 
 type ChatRole int
@@ -18,10 +19,23 @@ const (
 )
 
 type ChatRecord struct {
-	DBID    int // only used for DB operations
-	Role    ChatRole
-	Content string
-	// TODO: add more fields
+	DBID        int // only used for DB operations
+	Role        ChatRole
+	Content     string
+	MessageIDs  []int // Telegram messages the record was received or sent in
+	Attachments []Attachment
+}
+
+const (
+	AttachmentImage = "image"
+	AttachmentAudio = "audio" // only kept for models that take audio natively
+)
+
+type Attachment struct {
+	Kind         string
+	FileID       string // used to download the file from Telegram
+	FileUniqueID string // stable across bots and time, used as the cache key
+	Transcript   string // what was heard in audio, for models that cannot take it
 }
 
 type SessionState int
@@ -36,16 +50,27 @@ type FlattenRejection struct {
 	Models   mapset.Set[string]
 }
 
+// Session is guarded by its mutex, which is held while an update is processed
+// and while a finished response is recorded.
 type Session struct {
+	sync.Mutex
 	ID              int64
 	Model           string // model alias
 	ChatRecords     []ChatRecord
 	State           SessionState
-	StopChannel     chan struct{}
-	ResponseChannel chan string
+	CancelResponse  context.CancelCauseFunc // cancels the in-flight generation, if any
+	Epoch           int                     // bumped when the history is reset, so stale responses are discarded
+	Pending         []*botapi.Message       // messages waiting to be answered, see util.QueuePolicyQueue
+	DebounceSeq     int                     // identifies the latest debounce timer
+	Rerun           *botapi.Message         // edited prompt to answer once the in-flight response ends
+	MediaGroupID    string                  // album of the latest message, whose items form one turn
 	AvailableModels mapset.Set[string]
 	Temperature     float32
 	Prompt          string
+	VoiceReplies    bool          // answer voice messages with voice as well
+	ConversationID  int64         // conversation that ChatRecords belong to
+	Summary         string        // running summary of records that left the history
+	EditThrottler   chan struct{} // paces the edits of streamed replies in the session's chat
 }
 
 type Response struct {
@@ -55,23 +80,22 @@ type Response struct {
 
 type State struct {
 	Config            *util.Config
-	CachedProviderMap map[string]*openai.Client // map of provider name to provider
-	CachedModelMap    map[string]*util.Model    // map of model alias to model
-	CachedPromptMap   map[string]string         // map of prompt name to prompt
-	SessionMap        map[int64]*Session        // map of user ID to session
-	Bot               *botapi.BotAPI            // nullable
-	EditThrottler     chan struct{}
+	CachedProviderMap map[string]util.ChatBackend // map of provider name to provider
+	CachedModelMap    map[string]*util.Model      // map of model alias to model
+	CachedPromptMap   map[string]string           // map of prompt name to prompt
+	SessionMap        map[int64]*Session          // map of user ID to session
+	Bot               util.Messenger              // nullable
 	DB                *sql.DB
+	Responses         sync.WaitGroup // in-flight responses
 }
 
 func New(config *util.Config) (state *State) {
 	state = &State{
 		Config:            config,
-		CachedProviderMap: make(map[string]*openai.Client),
+		CachedProviderMap: make(map[string]util.ChatBackend),
 		CachedModelMap:    make(map[string]*util.Model),
 		CachedPromptMap:   make(map[string]string),
 		SessionMap:        make(map[int64]*Session),
-		EditThrottler:     util.NewThrottler(2000),
 	}
 
 	for _, prompt := range config.Prompts {
@@ -79,9 +103,12 @@ func New(config *util.Config) (state *State) {
 	}
 
 	for _, provider := range config.Providers {
-		clientConfig := openai.DefaultConfig(provider.APIKey)
-		clientConfig.BaseURL = provider.BaseURL
-		state.CachedProviderMap[provider.Name] = openai.NewClientWithConfig(clientConfig)
+		backend, err := util.NewChatBackend(provider)
+		if err != nil {
+			slog.Error("failed to create provider backend", "provider", provider.Name, "error", err)
+			continue
+		}
+		state.CachedProviderMap[provider.Name] = backend
 	}
 
 	// Open (or create) the sqlite DB in the data directory.
@@ -119,11 +146,10 @@ func New(config *util.Config) (state *State) {
 			Model:           config.DefaultModel,
 			ChatRecords:     make([]ChatRecord, 0, 16),
 			State:           StateIdle,
-			StopChannel:     make(chan struct{}),
-			ResponseChannel: make(chan string),
 			AvailableModels: allModelsSet.Clone(),
 			Temperature:     config.DefaultTemperature,
 			Prompt:          config.DefaultSystemPrompt,
+			EditThrottler:   util.NewThrottler(2000),
 		}
 
 		// Load persisted session (if any).
@@ -133,19 +159,27 @@ func New(config *util.Config) (state *State) {
 				session.Model = stored.Model
 			}
 			session.Temperature = stored.Temperature
+			session.VoiceReplies = stored.VoiceReplies
 			if _, ok := state.CachedPromptMap[stored.Prompt]; ok {
 				session.Prompt = stored.Prompt
 			}
+			session.ConversationID = stored.ConversationID
+			session.Summary = stored.Summary
 			if len(stored.ChatRecords) > 0 {
 				session.ChatRecords = stored.ChatRecords
 			}
 		} else if err == sql.ErrNoRows {
 			// No session in DB: create session row with default values.
 			slog.Warn("no session found in DB", "user_id", user)
-			UpdateSessionMetadata(state.DB, user, session.Model, session.Temperature, session.Prompt)
+			UpdateSessionMetadata(state.DB, user, session.Model, session.Temperature, session.Prompt, session.VoiceReplies)
 		} else {
 			slog.Error("failed to load session", "user_id", user, "error", err)
 		}
+		if session.ConversationID == 0 {
+			if err := startConversation(state, session); err != nil {
+				slog.Error("failed to create conversation", "user_id", user, "error", err)
+			}
+		}
 
 		state.SessionMap[user] = session
 
@@ -158,13 +192,32 @@ func New(config *util.Config) (state *State) {
 	return
 }
 
-func (r *ChatRecord) ToOpenAIChatMessage() openai.ChatCompletionMessage {
-	role := openai.ChatMessageRoleAssistant
+// ToChatMessage converts the record, attaching the files found in blobs and leaving
+// the transcript of audio, or a placeholder, for the others.
+func (r *ChatRecord) ToChatMessage(blobs map[string][]byte) util.ChatMessage {
+	role := util.ChatRoleAssistant
 	if r.Role == RoleUser {
-		role = openai.ChatMessageRoleUser
+		role = util.ChatRoleUser
 	}
-	return openai.ChatCompletionMessage{
-		Role:    role,
-		Content: r.Content,
+	msg := util.NewTextMessage(role, r.Content)
+	if r.Content == "" && len(r.Attachments) > 0 {
+		// The attachments stand on their own, without an empty text part.
+		msg.Parts = nil
+	}
+	for _, attachment := range r.Attachments {
+		blob, ok := blobs[attachment.FileUniqueID]
+		switch {
+		case attachment.Kind == AttachmentImage && ok:
+			msg.Parts = append(msg.Parts, util.ChatPart{Type: util.ChatPartImage, Data: blob})
+		case attachment.Kind == AttachmentImage:
+			msg.Parts = append(msg.Parts, util.ChatPart{Type: util.ChatPartText, Text: "[image omitted]"})
+		case attachment.Kind == AttachmentAudio && ok:
+			msg.Parts = append(msg.Parts, util.ChatPart{Type: util.ChatPartAudio, Data: blob})
+		case attachment.Kind == AttachmentAudio && attachment.Transcript != "":
+			msg.Parts = append(msg.Parts, util.ChatPart{Type: util.ChatPartText, Text: attachment.Transcript})
+		case attachment.Kind == AttachmentAudio:
+			msg.Parts = append(msg.Parts, util.ChatPart{Type: util.ChatPartText, Text: "[voice message omitted]"})
+		}
 	}
+	return msg
 }
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+)
+
+const summaryInstruction = `You maintain a running summary of a conversation between a user and an AI assistant.
+Merge the previous summary with the new turns below into one updated summary.
+Keep facts, names, decisions, open questions and the user's preferences; drop small talk.
+Write in the language of the conversation, in no more than 300 words. Reply with the summary only.`
+
+// summarizeHistory folds records that are about to leave the history into the running summary.
+func summarizeHistory(ctx context.Context, botState *State, summary string, records []ChatRecord) (string, error) {
+	model, ok := botState.CachedModelMap[botState.Config.SummaryModel]
+	if !ok {
+		return summary, fmt.Errorf("summary model not configured: %s", botState.Config.SummaryModel)
+	}
+	backend, ok := botState.CachedProviderMap[model.Provider]
+	if !ok {
+		return summary, fmt.Errorf("provider not found: %s", model.Provider)
+	}
+
+	var transcript strings.Builder
+	if summary != "" {
+		fmt.Fprintf(&transcript, "Previous summary:\n%s\n\n", summary)
+	}
+	transcript.WriteString("New turns:\n")
+	for _, record := range records {
+		if record.Content == "" && len(record.Attachments) == 0 {
+			continue
+		}
+		role := "User"
+		if record.Role == RoleBot {
+			role = "Assistant"
+		}
+		content := record.Content
+		for _, attachment := range record.Attachments {
+			if attachment.Transcript != "" {
+				content = strings.TrimSpace(content + " " + attachment.Transcript)
+				continue
+			}
+			content = strings.TrimSpace(content + " [" + attachment.Kind + "]")
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", role, content)
+	}
+
+	ctx, cancel := modelContext(ctx, model)
+	defer cancel()
+	resp, err := backend.CreateChat(ctx, util.ChatRequest{
+		Model:         model.Name,
+		API:           model.API,
+		SystemPrompt:  summaryInstruction,
+		DeveloperRole: !model.SystemPrompt,
+		Messages:      []util.ChatMessage{util.NewTextMessage(util.ChatRoleUser, transcript.String())},
+		MaxTokens:     botState.Config.MaxTokensPerResponse,
+	})
+	if err != nil {
+		return summary, err
+	}
+	return strings.TrimSpace(resp.Content), nil
+}
+
+// withSummary injects the running summary after the system prompt.
+func withSummary(systemPrompt string, summary string) string {
+	if summary == "" {
+		return systemPrompt
+	}
+	return systemPrompt + "\n\nSummary of the earlier conversation:\n" + summary
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rewired-gh/ichigo-bot/internal/util"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var errAudioMissing = errors.New("audio could not be downloaded")
+
+// messageAudio returns the voice message or audio file of a message, or nil if it has none.
+func messageAudio(msg *botapi.Message) *Attachment {
+	switch {
+	case msg.Voice != nil:
+		return &Attachment{Kind: AttachmentAudio, FileID: msg.Voice.FileID, FileUniqueID: msg.Voice.FileUniqueID}
+	case msg.Audio != nil:
+		return &Attachment{Kind: AttachmentAudio, FileID: msg.Audio.FileID, FileUniqueID: msg.Audio.FileUniqueID}
+	default:
+		return nil
+	}
+}
+
+// hearsAudio reports whether model can hear audio itself rather than a transcript of it.
+func hearsAudio(model *util.Model, backend util.ChatBackend, audio []byte) bool {
+	return model.AudioInput && util.AcceptsAudio(backend, model.API, audio)
+}
+
+// audioFileName names the upload for the transcription endpoint, which guesses the format from it.
+func audioFileName(msg *botapi.Message) string {
+	if msg.Audio != nil && msg.Audio.FileName != "" {
+		return msg.Audio.FileName
+	}
+	return "voice.ogg"
+}
+
+// transcriptionTimeout bounds transcriptions with models that have no timeout of their own.
+const transcriptionTimeout = 2 * time.Minute
+
+// transcribe turns audio into text with the transcription model.
+func transcribe(ctx context.Context, botState *State, fileName string, audio []byte) (string, error) {
+	model, ok := botState.CachedModelMap[botState.Config.TranscriptionModel]
+	if !ok {
+		return "", fmt.Errorf("transcription model not configured: %s", botState.Config.TranscriptionModel)
+	}
+	backend, ok := botState.CachedProviderMap[model.Provider]
+	if !ok {
+		return "", fmt.Errorf("provider not found: %s", model.Provider)
+	}
+	transcriber, ok := backend.(util.Transcriber)
+	if !ok {
+		return "", fmt.Errorf("provider does not support transcription: %s", model.Provider)
+	}
+
+	ctx, cancel := modelContext(ctx, model)
+	defer cancel()
+	if model.Timeout <= 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, transcriptionTimeout)
+		defer cancelTimeout()
+	}
+	transcript, err := transcriber.Transcribe(ctx, model.Name, fileName, audio)
+	return strings.TrimSpace(transcript), err
+}
+
+// transcribeAudio transcribes the audio of the prompt that model cannot hear itself, unless an
+// earlier model of the turn needed it too, and echoes each transcript so the user can check it.
+// It runs with the response, so the session stays free and /stop cancels it.
+func transcribeAudio(ctx context.Context, botState *State, turn *responseTurn, model *util.Model, backend util.ChatBackend, blobs map[string][]byte) {
+	prompt := &turn.records[len(turn.records)-1]
+	for i, audio := range prompt.Attachments {
+		if audio.Kind != AttachmentAudio || audio.Transcript != "" {
+			continue
+		}
+		blob, ok := blobs[audio.FileUniqueID]
+		if ok && hearsAudio(model, backend, blob) {
+			continue
+		}
+		msg := turn.inputs[len(turn.inputs)-1]
+		if j := slices.IndexFunc(turn.inputs, func(msg *botapi.Message) bool {
+			input := messageAudio(msg)
+			return input != nil && input.FileUniqueID == audio.FileUniqueID
+		}); j >= 0 {
+			msg = turn.inputs[j]
+		}
+
+		var transcript string
+		err := errAudioMissing
+		if ok {
+			transcript, err = transcribe(ctx, botState, audioFileName(msg), blob)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("failed to transcribe audio", "error", err, "file_id", audio.FileID)
+			util.SendMessageQuick(msg.Chat.ID, "Failed to transcribe the voice message.", botState.Bot)
+			continue
+		}
+		if transcript == "" {
+			continue
+		}
+		if _, err := util.SendMessageMarkdown(msg.Chat.ID, quoteTranscript(transcript), botState.Bot, botState.Config.RenderMode()); err != nil {
+			slog.Warn("failed to echo transcript", "error", err)
+		}
+		// The attachments are shared with the session until the response is recorded.
+		if !turn.transcribed {
+			prompt.Attachments = slices.Clone(prompt.Attachments)
+			turn.transcribed = true
+		}
+		prompt.Attachments[i].Transcript = transcript
+	}
+}
+
+// storeTranscripts keeps the transcripts made while answering prompt with its record in the session.
+func storeTranscripts(botState *State, session *Session, prompt ChatRecord) {
+	i := slices.IndexFunc(session.ChatRecords, func(record ChatRecord) bool { return record.DBID == prompt.DBID })
+	if i < 0 {
+		return
+	}
+	session.ChatRecords[i].Attachments = prompt.Attachments
+	var transcripts []string
+	for _, attachment := range prompt.Attachments {
+		if attachment.Transcript != "" {
+			SetAttachmentTranscript(botState.DB, int64(prompt.DBID), attachment.FileUniqueID, attachment.Transcript)
+			transcripts = append(transcripts, attachment.Transcript)
+		}
+	}
+	// A prompt of voice alone titles the conversation with what was said.
+	setConversationTitle(botState, session, strings.Join(transcripts, "\n\n"))
+}
+
+// quoteTranscript formats a transcript as a Markdown quote, so the user can check what was heard.
+func quoteTranscript(transcript string) string {
+	return "> " + strings.ReplaceAll(transcript, "\n", "\n> ")
+}
+
+// speechInputLimit is the longest text the speech endpoint reads at once.
+const speechInputLimit = 4096
+
+// speak sends a reply to the chat as a voice message read by the speech model.
+func speak(botState *State, chatID int64, content string) error {
+	model, ok := botState.CachedModelMap[botState.Config.SpeechModel]
+	if !ok {
+		return fmt.Errorf("speech model not configured: %s", botState.Config.SpeechModel)
+	}
+	backend, ok := botState.CachedProviderMap[model.Provider]
+	if !ok {
+		return fmt.Errorf("provider not found: %s", model.Provider)
+	}
+	synthesizer, ok := backend.(util.Synthesizer)
+	if !ok {
+		return fmt.Errorf("provider does not support speech: %s", model.Provider)
+	}
+
+	// Read the rendered text rather than the Markdown source.
+	text, _ := util.RenderEntities(strings.TrimSuffix(strings.TrimSuffix(content, stoppedMarker), failedMarker))
+	if runes := []rune(text); len(runes) > speechInputLimit {
+		slog.Warn("cutting off long text for speech", "length", len(runes))
+		text = string(runes[:speechInputLimit])
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	if err := botState.Bot.SendChatAction(chatID, botapi.ChatRecordVoice); err != nil {
+		slog.Warn("failed to send chat action", "error", err)
+	}
+	ctx, cancel := modelContext(context.Background(), model)
+	defer cancel()
+	speech, err := synthesizer.Synthesize(ctx, model.Name, botState.Config.SpeechVoice, text)
+	if err != nil {
+		return err
+	}
+	_, err = botState.Bot.SendVoice(botapi.NewVoice(chatID, botapi.FileBytes{Name: "speech.ogg", Bytes: speech}))
+	return err
+}
@@ -0,0 +1,291 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicDefaultBaseURL = "https://api.anthropic.com/v1"
+	anthropicVersion        = "2023-06-01"
+	anthropicDefaultTokens  = 4096
+	anthropicMaxTemperature = 1 // the API rejects anything above, unlike OpenAI which goes up to 2
+)
+
+// anthropicBackend talks to the native Anthropic Messages API.
+type anthropicBackend struct {
+	baseURL  string
+	apiKey   string
+	authType string
+	client   *http.Client
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicEvent covers the fields of every streaming event type that are used here.
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicStream struct {
+	body   io.ReadCloser
+	events *sseReader
+	usage  ChatUsage
+}
+
+func newAnthropicBackend(provider Provider) (*anthropicBackend, error) {
+	switch provider.AuthType {
+	case "", AuthTypeBearer, AuthTypeNone:
+	default:
+		return nil, fmt.Errorf("unsupported auth type for anthropic provider %s: %s", provider.Name, provider.AuthType)
+	}
+	client, err := newProviderHTTPClient(provider)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = anthropicDefaultBaseURL
+	}
+	return &anthropicBackend{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		apiKey:   provider.APIKey,
+		authType: provider.AuthType,
+		client:   client,
+	}, nil
+}
+
+func (b *anthropicBackend) CreateChat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := b.post(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var anthropicResp anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&anthropicResp); err != nil {
+		return ChatResponse{}, err
+	}
+	var content strings.Builder
+	for _, block := range anthropicResp.Content {
+		if block.Type == "text" {
+			content.WriteString(block.Text)
+		}
+	}
+	return ChatResponse{
+		Content:      content.String(),
+		FinishReason: anthropicFinishReason(anthropicResp.StopReason),
+		Usage: &ChatUsage{
+			PromptTokens:     anthropicResp.Usage.InputTokens,
+			CompletionTokens: anthropicResp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (b *anthropicBackend) CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	resp, err := b.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return &anthropicStream{body: resp.Body, events: newSSEReader(resp.Body)}, nil
+}
+
+func (b *anthropicBackend) post(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	body, err := json.Marshal(toAnthropicRequest(req, stream))
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if b.authType != AuthTypeNone {
+		httpReq.Header.Set("X-Api-Key", b.apiKey)
+	}
+	httpReq.Header.Set("Anthropic-Version", anthropicVersion)
+
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp anthropicErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Message == "" {
+			return nil, fmt.Errorf("anthropic API error: status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("anthropic API error: status %d: %s: %s", resp.StatusCode, errResp.Error.Type, errResp.Error.Message)
+	}
+	return resp, nil
+}
+
+func (s *anthropicStream) Recv() (ChatDelta, error) {
+	for {
+		data, err := s.events.Next()
+		if err != nil {
+			return ChatDelta{}, err
+		}
+
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return ChatDelta{}, err
+		}
+		switch event.Type {
+		case "message_start":
+			s.usage.PromptTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				return ChatDelta{Content: event.Delta.Text}, nil
+			}
+		case "message_delta":
+			s.usage.CompletionTokens = event.Usage.OutputTokens
+			usage := s.usage
+			return ChatDelta{FinishReason: anthropicFinishReason(event.Delta.StopReason), Usage: &usage}, nil
+		case "message_stop":
+			return ChatDelta{}, io.EOF
+		case "error":
+			return ChatDelta{}, fmt.Errorf("anthropic stream error: %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
+
+func toAnthropicRequest(req ChatRequest, stream bool) anthropicRequest {
+	maxTokens := req.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = anthropicDefaultTokens
+	}
+	anthropicReq := anthropicRequest{
+		Model:       req.Model,
+		System:      req.SystemPrompt,
+		MaxTokens:   maxTokens,
+		Temperature: req.Temperature,
+		Stream:      stream,
+	}
+	if req.Temperature != nil && *req.Temperature > anthropicMaxTemperature {
+		temperature := float32(anthropicMaxTemperature)
+		anthropicReq.Temperature = &temperature
+	}
+
+	for _, msg := range req.Messages {
+		role := "assistant"
+		if msg.Role == ChatRoleUser {
+			role = "user"
+		}
+		// The conversation has to start with a user turn.
+		if len(anthropicReq.Messages) == 0 && role != "user" {
+			continue
+		}
+
+		blocks := make([]anthropicContentBlock, 0, len(msg.Parts))
+		for _, part := range msg.Parts {
+			switch part.Type {
+			case ChatPartText:
+				if part.Text != "" {
+					blocks = append(blocks, anthropicContentBlock{Type: "text", Text: part.Text})
+				}
+			case ChatPartImage:
+				mediaType, err := DetectImageType(part.Data)
+				if err != nil {
+					continue
+				}
+				blocks = append(blocks, anthropicContentBlock{
+					Type: "image",
+					Source: &anthropicImageSource{
+						Type:      "base64",
+						MediaType: mediaType,
+						Data:      base64.StdEncoding.EncodeToString(part.Data),
+					},
+				})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Consecutive turns of the same role are merged, since roles must alternate.
+		if n := len(anthropicReq.Messages); n > 0 && anthropicReq.Messages[n-1].Role == role {
+			anthropicReq.Messages[n-1].Content = append(anthropicReq.Messages[n-1].Content, blocks...)
+			continue
+		}
+		anthropicReq.Messages = append(anthropicReq.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+	return anthropicReq
+}
+
+// anthropicFinishReason maps stop reasons onto the OpenAI vocabulary used elsewhere.
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	default:
+		return stopReason
+	}
+}
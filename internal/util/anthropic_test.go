@@ -0,0 +1,192 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// newAnthropicTestBackend serves handler as the Messages API and records the decoded requests.
+func newAnthropicTestBackend(t *testing.T, handler http.HandlerFunc) (ChatBackend, *[]anthropicRequest) {
+	t.Helper()
+	var requests []anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" {
+			t.Errorf("request path = %s, want /messages", r.URL.Path)
+		}
+		if got := r.Header.Get("X-Api-Key"); got != "test-key" {
+			t.Errorf("X-Api-Key = %q, want test-key", got)
+		}
+		if got := r.Header.Get("Anthropic-Version"); got != anthropicVersion {
+			t.Errorf("Anthropic-Version = %q, want %s", got, anthropicVersion)
+		}
+		var req anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		requests = append(requests, req)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	backend, err := NewChatBackend(Provider{Name: "test", Type: ProviderTypeAnthropic, BaseURL: server.URL, APIKey: "test-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, &requests
+}
+
+func testChatRequest() ChatRequest {
+	temperature := float32(0.5)
+	return ChatRequest{
+		Model:        "claude-test",
+		SystemPrompt: "Be brief.",
+		Messages: []ChatMessage{
+			NewTextMessage(ChatRoleAssistant, "dropped, as the conversation must start with the user"),
+			{Role: ChatRoleUser, Parts: []ChatPart{{Type: ChatPartText, Text: "What is this?"}, {Type: ChatPartImage, Data: testPNG}}},
+			NewTextMessage(ChatRoleUser, "Answer in one word."),
+		},
+		MaxTokens:   100,
+		Temperature: &temperature,
+	}
+}
+
+func TestAnthropicCreateChat(t *testing.T) {
+	backend, requests := newAnthropicTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"content":[{"type":"text","text":"A "},{"type":"text","text":"picture."}],"stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":3}}`)
+	})
+
+	resp, err := backend.CreateChat(context.Background(), testChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "A picture." || resp.FinishReason != "stop" {
+		t.Errorf("response = %+v, want content %q and finish reason stop", resp, "A picture.")
+	}
+	if resp.Usage == nil || resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 3 {
+		t.Errorf("usage = %+v, want 12 prompt and 3 completion tokens", resp.Usage)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*requests))
+	}
+	req := (*requests)[0]
+	if req.System != "Be brief." || req.Stream || req.MaxTokens != 100 {
+		t.Errorf("request = %+v, want the system field, max tokens and no streaming", req)
+	}
+	if req.Temperature == nil || *req.Temperature != 0.5 {
+		t.Errorf("temperature = %v, want 0.5", req.Temperature)
+	}
+	if len(req.Messages) != 1 || req.Messages[0].Role != "user" {
+		t.Fatalf("messages = %+v, want a single merged user turn", req.Messages)
+	}
+	blocks := req.Messages[0].Content
+	if len(blocks) != 3 || blocks[0].Text != "What is this?" || blocks[2].Text != "Answer in one word." {
+		t.Fatalf("content blocks = %+v, want text, image, text", blocks)
+	}
+	image := blocks[1]
+	if image.Type != "image" || image.Source == nil || image.Source.Type != "base64" || image.Source.MediaType != "image/png" {
+		t.Errorf("image block = %+v, want a base64 image/png source", image)
+	}
+}
+
+func TestAnthropicCreateChatStream(t *testing.T) {
+	backend, requests := newAnthropicTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, strings.Join([]string{
+			"event: message_start",
+			`data: {"type":"message_start","message":{"usage":{"input_tokens":7,"output_tokens":1}}}`,
+			"",
+			"event: ping",
+			`data: {"type":"ping"}`,
+			"",
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+			"",
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+			"",
+			`data: {"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":2}}`,
+			"",
+			`data: {"type":"message_stop"}`,
+			"",
+		}, "\n"))
+	})
+
+	stream, err := backend.CreateChatStream(context.Background(), testChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var content string
+	var last ChatDelta
+	for {
+		delta, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += delta.Content
+		if delta.FinishReason != "" {
+			last = delta
+		}
+	}
+	if content != "Hello" {
+		t.Errorf("streamed content = %q, want Hello", content)
+	}
+	if last.FinishReason != "length" || last.Usage == nil || last.Usage.PromptTokens != 7 || last.Usage.CompletionTokens != 2 {
+		t.Errorf("final delta = %+v, want finish reason length with usage 7/2", last)
+	}
+	if len(*requests) != 1 || !(*requests)[0].Stream {
+		t.Errorf("requests = %+v, want one streaming request", *requests)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	backend, _ := newAnthropicTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`+"\n\n")
+	})
+
+	stream, err := backend.CreateChatStream(context.Background(), testChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Recv(); err == nil || !strings.Contains(err.Error(), "overloaded_error: Overloaded") {
+		t.Errorf("Recv() error = %v, want the stream error", err)
+	}
+}
+
+func TestAnthropicErrorResponse(t *testing.T) {
+	backend, _ := newAnthropicTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}`)
+	})
+
+	_, err := backend.CreateChat(context.Background(), testChatRequest())
+	if err == nil || !strings.Contains(err.Error(), "status 400: invalid_request_error: max_tokens: too large") {
+		t.Errorf("CreateChat() error = %v, want the API error", err)
+	}
+}
+
+func TestAnthropicTemperatureClamped(t *testing.T) {
+	req := testChatRequest()
+	temperature := float32(1.5)
+	req.Temperature = &temperature
+
+	anthropicReq := toAnthropicRequest(req, false)
+	if anthropicReq.Temperature == nil || *anthropicReq.Temperature != 1 {
+		t.Errorf("temperature = %v, want 1", anthropicReq.Temperature)
+	}
+	if temperature != 1.5 {
+		t.Errorf("request temperature was modified to %v", temperature)
+	}
+}
@@ -0,0 +1,264 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Transcriber is a backend with a speech-to-text endpoint.
+type Transcriber interface {
+	Transcribe(ctx context.Context, model string, fileName string, audio []byte) (string, error)
+}
+
+// Synthesizer is a backend with a text-to-speech endpoint.
+type Synthesizer interface {
+	Synthesize(ctx context.Context, model string, voice string, text string) ([]byte, error)
+}
+
+// DetectAudioFormat returns the format name of audio bytes as used by input_audio, e.g. "ogg" or "mp3".
+func DetectAudioFormat(audio []byte) (string, error) {
+	switch contentType := http.DetectContentType(audio); contentType {
+	case "application/ogg":
+		return "ogg", nil
+	case "audio/mpeg":
+		return "mp3", nil
+	case "audio/wave":
+		return "wav", nil
+	case "audio/aiff":
+		return "aiff", nil
+	case "video/mp4":
+		return "m4a", nil
+	default:
+		return "", fmt.Errorf("invalid audio content type: %s", contentType)
+	}
+}
+
+// inputAudioFormats are the formats that chat completions take as input_audio.
+var inputAudioFormats = []string{"wav", "mp3"}
+
+// AcceptsAudio reports whether backend can pass audio straight to a model using api.
+// Only OpenAI chat completions take audio, and only as WAV or MP3, so Telegram voice
+// messages, which are OGG/Opus, always have to be transcribed.
+func AcceptsAudio(backend ChatBackend, api string, audio []byte) bool {
+	if _, ok := backend.(*openAIBackend); !ok || api == ModelAPIResponses {
+		return false
+	}
+	format, err := DetectAudioFormat(audio)
+	return err == nil && slices.Contains(inputAudioFormats, format)
+}
+
+func (b *openAIBackend) Transcribe(ctx context.Context, model string, fileName string, audio []byte) (string, error) {
+	resp, err := b.client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    model,
+		FilePath: fileName,
+		Reader:   bytes.NewReader(audio),
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Text, nil
+}
+
+// Synthesize returns speech as OGG/Opus, the format of Telegram voice messages.
+func (b *openAIBackend) Synthesize(ctx context.Context, model string, voice string, text string) ([]byte, error) {
+	resp, err := b.client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(voice),
+		ResponseFormat: openai.SpeechResponseFormatOpus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	return io.ReadAll(resp)
+}
+
+// go-openai has no input_audio content parts, so chat completions carrying audio are sent by hand.
+
+type openAIAudioRequest struct {
+	openai.ChatCompletionRequest
+	Messages []any `json:"messages"` // shadows the embedded field
+}
+
+type openAIAudioMessage struct {
+	Role    string            `json:"role"`
+	Content []openAIAudioPart `json:"content"`
+}
+
+type openAIAudioPart struct {
+	Type       string                      `json:"type"`
+	Text       string                      `json:"text,omitempty"`
+	ImageURL   *openai.ChatMessageImageURL `json:"image_url,omitempty"`
+	InputAudio *openAIInputAudio           `json:"input_audio,omitempty"`
+}
+
+type openAIInputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+type openAIAudioStream struct {
+	body   io.ReadCloser
+	events *sseReader
+}
+
+func hasAudio(msg ChatMessage) bool {
+	for _, part := range msg.Parts {
+		if part.Type == ChatPartAudio {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *openAIBackend) createAudioChat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := b.postAudioChat(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var chatResp openai.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+		return ChatResponse{}, err
+	}
+	if len(chatResp.Choices) == 0 {
+		return ChatResponse{}, fmt.Errorf("empty response choices")
+	}
+	return ChatResponse{
+		Content:      chatResp.Choices[0].Message.Content,
+		FinishReason: string(chatResp.Choices[0].FinishReason),
+		Usage:        fromOpenAIUsage(&chatResp.Usage),
+	}, nil
+}
+
+func (b *openAIBackend) createAudioChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	resp, err := b.postAudioChat(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return &openAIAudioStream{body: resp.Body, events: newSSEReader(resp.Body)}, nil
+}
+
+func (b *openAIBackend) postAudioChat(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	audioReq, err := toOpenAIAudioRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	audioReq.Stream = stream
+	body, err := json.Marshal(audioReq)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.chatCompletionsURL(req.Model), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	b.authorize(httpReq)
+
+	resp, err := b.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp openai.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return nil, fmt.Errorf("chat completions error: status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("chat completions error: status %d: %s", resp.StatusCode, errResp.Error.Message)
+	}
+	return resp, nil
+}
+
+func (b *openAIBackend) chatCompletionsURL(model string) string {
+	if b.provider.AuthType == AuthTypeAzure {
+		return b.baseURL + "/openai/deployments/" + url.PathEscape(b.provider.DeploymentFor(model)) +
+			"/chat/completions?api-version=" + url.QueryEscape(b.provider.azureAPIVersion(azureDefaultAPIVersion))
+	}
+	return b.baseURL + "/chat/completions"
+}
+
+func (s *openAIAudioStream) Recv() (ChatDelta, error) {
+	for {
+		data, err := s.events.Next()
+		if err != nil {
+			return ChatDelta{}, err
+		}
+		if data == "[DONE]" {
+			return ChatDelta{}, io.EOF
+		}
+
+		var resp openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(data), &resp); err != nil {
+			return ChatDelta{}, err
+		}
+		delta := ChatDelta{Usage: fromOpenAIUsage(resp.Usage)}
+		if len(resp.Choices) > 0 {
+			delta.Content = resp.Choices[0].Delta.Content
+			delta.FinishReason = string(resp.Choices[0].FinishReason)
+		}
+		return delta, nil
+	}
+}
+
+func (s *openAIAudioStream) Close() error {
+	return s.body.Close()
+}
+
+// toOpenAIAudioRequest converts messages with audio by hand and leaves the others to go-openai.
+func toOpenAIAudioRequest(req ChatRequest) (openAIAudioRequest, error) {
+	openaiReq, err := toOpenAIRequest(req)
+	if err != nil {
+		return openAIAudioRequest{}, err
+	}
+	msgs := make([]any, 0, len(openaiReq.Messages))
+	msgs = append(msgs, openaiReq.Messages[0])
+	for i, msg := range req.Messages {
+		if !hasAudio(msg) {
+			msgs = append(msgs, openaiReq.Messages[i+1])
+			continue
+		}
+		audioMsg := openAIAudioMessage{Role: openaiReq.Messages[i+1].Role}
+		for _, part := range msg.Parts {
+			switch part.Type {
+			case ChatPartText:
+				if part.Text != "" {
+					audioMsg.Content = append(audioMsg.Content, openAIAudioPart{Type: "text", Text: part.Text})
+				}
+			case ChatPartImage:
+				base64Image, err := EncodeImageToBase64(part.Data)
+				if err != nil {
+					return openAIAudioRequest{}, err
+				}
+				audioMsg.Content = append(audioMsg.Content, openAIAudioPart{Type: "image_url", ImageURL: &openai.ChatMessageImageURL{URL: base64Image}})
+			case ChatPartAudio:
+				format, err := DetectAudioFormat(part.Data)
+				if err != nil {
+					return openAIAudioRequest{}, err
+				}
+				if !slices.Contains(inputAudioFormats, format) {
+					return openAIAudioRequest{}, fmt.Errorf("unsupported input audio format: %s", format)
+				}
+				audioMsg.Content = append(audioMsg.Content, openAIAudioPart{
+					Type:       "input_audio",
+					InputAudio: &openAIInputAudio{Data: base64.StdEncoding.EncodeToString(part.Data), Format: format},
+				})
+			}
+		}
+		msgs = append(msgs, audioMsg)
+	}
+	return openAIAudioRequest{ChatCompletionRequest: openaiReq, Messages: msgs}, nil
+}
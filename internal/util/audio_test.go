@@ -0,0 +1,62 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	testOGG = []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00")
+	testWAV = []byte("RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+)
+
+func TestAcceptsAudio(t *testing.T) {
+	openAI, err := NewChatBackend(Provider{Name: "openai"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anthropic, err := NewChatBackend(Provider{Name: "anthropic", Type: ProviderTypeAnthropic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		backend ChatBackend
+		api     string
+		audio   []byte
+		want    bool
+	}{
+		{"chat completions wav", openAI, "", testWAV, true},
+		{"chat completions ogg", openAI, "", testOGG, false},
+		{"responses wav", openAI, ModelAPIResponses, testWAV, false},
+		{"anthropic wav", anthropic, "", testWAV, false},
+		{"not audio", openAI, "", []byte("hello"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AcceptsAudio(tt.backend, tt.api, tt.audio); got != tt.want {
+				t.Errorf("AcceptsAudio() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToOpenAIAudioRequestRejectsOGG(t *testing.T) {
+	req := ChatRequest{
+		Model:    "gpt-4o-audio-preview",
+		Messages: []ChatMessage{{Role: ChatRoleUser, Parts: []ChatPart{{Type: ChatPartAudio, Data: testOGG}}}},
+	}
+	if _, err := toOpenAIAudioRequest(req); err == nil || !strings.Contains(err.Error(), "ogg") {
+		t.Errorf("toOpenAIAudioRequest() error = %v, want unsupported format", err)
+	}
+
+	req.Messages[0].Parts[0].Data = testWAV
+	audioReq, err := toOpenAIAudioRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := audioReq.Messages[1].(openAIAudioMessage)
+	if !ok || msg.Content[0].InputAudio == nil || msg.Content[0].InputAudio.Format != "wav" {
+		t.Errorf("messages = %+v, want a wav input_audio part", audioReq.Messages)
+	}
+}
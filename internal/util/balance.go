@@ -0,0 +1,141 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BalanceMarkdown temporarily closes constructs left open in a partial Markdown snapshot,
+// such as an unterminated code fence, code span or emphasis, so that streamed previews
+// keep their formatting. Dangling markers with nothing after them are dropped instead.
+func BalanceMarkdown(content string) string {
+	blocks := splitBlocks(content)
+	if len(blocks) == 0 {
+		return content
+	}
+	last := blocks[len(blocks)-1]
+	if last.opener != "" {
+		closer := fenceRegexp.FindStringSubmatch(last.opener)[1]
+		lines := splitLines(last.content)
+		if len(lines) > 1 && isFenceCloser(lines[len(lines)-1], closer) {
+			return content
+		}
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return content + closer
+	}
+
+	prefix := content[:len(content)-len(last.content)]
+	return prefix + balanceInlines(last.content)
+}
+
+type inlineDelimiter struct {
+	marker string
+	pos    int
+}
+
+// balanceInlines closes open code spans and emphasis in the trailing paragraph.
+func balanceInlines(paragraph string) string {
+	state := scanInlines(paragraph)
+	if state.dangling >= 0 {
+		return balanceInlines(strings.TrimRight(paragraph[:state.dangling], " \t"))
+	}
+	codeMarker, codePos, stack := state.code, state.codePos, state.open
+
+	if codeMarker != "" {
+		if strings.TrimSpace(paragraph[codePos+len(codeMarker):]) == "" {
+			return strings.TrimRight(paragraph[:codePos], " \t")
+		}
+		return strings.TrimRight(paragraph, "\n") + codeMarker
+	}
+
+	balanced := strings.TrimRight(paragraph, " \t\n")
+	for i := len(stack) - 1; i >= 0; i-- {
+		balanced = strings.TrimRight(balanced, " \t\n")
+		if stack[i].pos+len(stack[i].marker) >= len(balanced) {
+			balanced = strings.TrimRight(balanced[:stack[i].pos], " \t")
+			continue
+		}
+		balanced += stack[i].marker
+	}
+	return balanced
+}
+
+// inlineState is what a paragraph leaves open at its end.
+type inlineState struct {
+	open     []inlineDelimiter // emphasis, outermost first
+	code     string            // marker of an open code span
+	codePos  int
+	dangling int // position of a trailing marker that may open emphasis once more text arrives, or -1
+}
+
+func scanInlines(paragraph string) inlineState {
+	var stack []inlineDelimiter
+	codeMarker := ""
+	codePos := 0
+	for i := 0; i < len(paragraph); {
+		c := paragraph[i]
+		if codeMarker == "" && c == '\\' {
+			i += 2
+			continue
+		}
+		if c == '`' {
+			run := delimiterRun(paragraph, i)
+			if codeMarker == "" {
+				codeMarker, codePos = run, i
+			} else if run == codeMarker {
+				codeMarker = ""
+			}
+			i += len(run)
+			continue
+		}
+		if codeMarker != "" || (c != '*' && c != '_' && c != '~') {
+			i++
+			continue
+		}
+
+		run := delimiterRun(paragraph, i)
+		marker := run
+		if len(marker) > 2 {
+			marker = marker[:2]
+		}
+		before, _ := utf8.DecodeLastRuneInString(paragraph[:i])
+		after, _ := utf8.DecodeRuneInString(paragraph[i+len(run):])
+		canOpen := i+len(run) < len(paragraph) && !unicode.IsSpace(after)
+		canClose := i > 0 && !unicode.IsSpace(before)
+		if c == '_' && canOpen && canClose && isWordRune(before) && isWordRune(after) {
+			i += len(run)
+			continue
+		}
+		if c == '~' && len(run) < 2 {
+			i += len(run)
+			continue
+		}
+
+		if canClose && len(stack) > 0 && stack[len(stack)-1].marker == marker {
+			stack = stack[:len(stack)-1]
+		} else if canOpen {
+			stack = append(stack, inlineDelimiter{marker: marker, pos: i})
+		} else if i+len(run) >= len(strings.TrimRight(paragraph, " \t\n")) && (c != '_' || !isWordRune(before)) {
+			// A trailing marker with nothing after it yet. An underscore ending a word
+			// cannot open emphasis, so it stays as it is.
+			return inlineState{dangling: i}
+		}
+		i += len(run)
+	}
+	return inlineState{open: stack, code: codeMarker, codePos: codePos, dangling: -1}
+}
+
+func delimiterRun(content string, start int) string {
+	end := start
+	for end < len(content) && content[end] == content[start] {
+		end++
+	}
+	return content[start:end]
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
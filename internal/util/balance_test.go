@@ -0,0 +1,34 @@
+package util
+
+import "testing"
+
+func TestBalanceMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"unclosed fence with language", "```go\nx := 1", "```go\nx := 1\n```"},
+		{"closed fence", "```go\nx := 1\n```", "```go\nx := 1\n```"},
+		{"unclosed code span", "use `fmt.Println", "use `fmt.Println`"},
+		{"empty code span", "use `", "use"},
+		{"open bold", "**bold text", "**bold text**"},
+		{"open strikethrough", "~~gone", "~~gone~~"},
+		{"nested emphasis", "**a _b", "**a _b_**"},
+		{"dangling bold", "hello **", "hello"},
+		{"dangling strikethrough", "hello ~~", "hello"},
+		{"dangling closer inside bold", "**a **", "**a**"},
+		{"closed bold", "a **b**", "a **b**"},
+		{"snake_case word", "call snake_case", "call snake_case"},
+		{"snake_case word in progress", "call snake_", "call snake_"},
+		{"trailing underscore", "x_", "x_"},
+		{"escaped marker", `a \*`, `a \*`},
+		{"earlier paragraph untouched", "**a\n\nb **", "**a\n\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BalanceMarkdown(tt.in); got != tt.want {
+				t.Errorf("BalanceMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
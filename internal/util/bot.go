@@ -1,11 +1,7 @@
 package util
 
 import (
-	"bytes"
-	"io"
 	"log/slog"
-	"net/http"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -20,18 +16,6 @@ const ErrTooManyRequests = 429
 
 const MessageCharacterLimit = 4096 - 64
 
-const markdownifyPython = `
-import sys
-from telegramify_markdown import markdownify
-try:
-    input_str = sys.stdin.read()
-    result = markdownify(input_str)
-    sys.stdout.write(result)
-except Exception as e:
-    sys.stderr.write(f"Error: {str(e)}")
-    sys.exit(1)
-`
-
 func escapeTelegramMarkdownSimple(content string) string {
 	replacements := []struct {
 		old string
@@ -47,65 +31,32 @@ func escapeTelegramMarkdownSimple(content string) string {
 	return content
 }
 
-func telegramifyMarkdown(content string) (string, error) {
-	cmd := exec.Command("python3", "-c", markdownifyPython)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return "", err
-	}
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Start(); err != nil {
-		stdin.Close()
-		return "", err
-	}
+type RenderMode int
 
-	if _, err := io.WriteString(stdin, content); err != nil {
-		stdin.Close()
-		return "", err
-	}
-	stdin.Close()
+const (
+	RenderModeEscaped    RenderMode = iota // MarkdownV2 with only basic escaping
+	RenderModeMarkdownV2                   // Markdown converted to MarkdownV2
+	RenderModeEntities                     // plain text with message entities
+)
 
-	if err := cmd.Wait(); err != nil {
-		return "", err
+// renderMessage fills in the text and formatting fields shared by sent and edited messages.
+func renderMessage(content string, mode RenderMode) (text string, parseMode string, entities []botapi.MessageEntity) {
+	switch mode {
+	case RenderModeEntities:
+		text, entities = RenderEntities(content)
+		return
+	case RenderModeMarkdownV2:
+		return RenderMarkdownV2(content), botapi.ModeMarkdownV2, nil
+	default:
+		return escapeTelegramMarkdownSimple(content), botapi.ModeMarkdownV2, nil
 	}
-
-	return stdout.String(), nil
 }
 
-func convertToTelegramMarkdown(content string, useTelegramify bool) (converted string) {
-	var err error
-	if useTelegramify {
-		converted, err = telegramifyMarkdown(content)
-		if err != nil {
-			slog.Error(err.Error())
-		}
-	}
-	if err != nil || !useTelegramify {
-		converted = escapeTelegramMarkdownSimple(content)
-	}
-	return
+func DownloadFile(fileID string, bot Messenger) ([]byte, error) {
+	return bot.DownloadFile(fileID)
 }
 
-func DownloadFile(fileID string, bot *botapi.BotAPI) ([]byte, error) {
-	fileURL, err := bot.GetFileDirectURL(fileID)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.Get(fileURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	return io.ReadAll(resp.Body)
-}
-
-func SendMessageQuick(chatID int64, content string, bot *botapi.BotAPI) {
+func SendMessageQuick(chatID int64, content string, bot Messenger) {
 	msg := botapi.NewMessage(chatID, content)
 	_, err := bot.Send(msg)
 	if err != nil {
@@ -113,44 +64,75 @@ func SendMessageQuick(chatID int64, content string, bot *botapi.BotAPI) {
 	}
 }
 
-func SendMessageMarkdown(chatID int64, content string, bot *botapi.BotAPI, useTelegramify bool) (botapi.Message, error) {
-	msg := botapi.NewMessage(chatID, convertToTelegramMarkdown(content, useTelegramify))
-	msg.ParseMode = botapi.ModeMarkdownV2
-	return bot.Send(msg)
+func SendMessageMarkdown(chatID int64, content string, bot Messenger, mode RenderMode) (botapi.Message, error) {
+	msg := botapi.NewMessage(chatID, "")
+	msg.Text, msg.ParseMode, msg.Entities = renderMessage(content, mode)
+	sent, err := bot.Send(msg)
+	if err != nil {
+		slog.Error(err.Error())
+
+		if retryAfter, ok := tooManyRequests(err); ok {
+			if retryAfter < 0 {
+				return sent, err
+			}
+			time.Sleep(retryAfter)
+			return SendMessageMarkdown(chatID, content, bot, mode)
+		}
+
+		msg.ParseMode = ""
+		msg.Entities = nil
+		sent, err = bot.Send(msg)
+		if err != nil {
+			slog.Error(err.Error())
+		}
+	}
+	return sent, err
 }
 
-func EditMessageMarkdown(chatID int64, messageID int, content string, bot *botapi.BotAPI, useTelegramify bool) {
-	editMsg := botapi.NewEditMessageText(chatID, messageID, convertToTelegramMarkdown(content, useTelegramify))
-	editMsg.ParseMode = botapi.ModeMarkdownV2
-	_, err := bot.Send(editMsg)
+func EditMessageMarkdown(chatID int64, messageID int, content string, bot Messenger, mode RenderMode) {
+	editMsg := botapi.NewEditMessageText(chatID, messageID, "")
+	editMsg.Text, editMsg.ParseMode, editMsg.Entities = renderMessage(content, mode)
+	err := bot.Edit(editMsg)
 	if err != nil {
-		errMsg := err.Error()
-		slog.Error(errMsg)
-
-		// errMsg = ERROR Too Many Requests: retry after <int>
-		if strings.Contains(errMsg, "Too Many Requests") {
-			re := regexp.MustCompile(`retry after (\d+)`)
-			matches := re.FindStringSubmatch(errMsg)
-			if len(matches) > 1 {
-				retryAfter, errConv := strconv.Atoi(matches[1])
-				if errConv == nil {
-					time.Sleep(time.Duration(retryAfter+1) * time.Second)
-					EditMessageMarkdown(chatID, messageID, content, bot, useTelegramify)
-				} else {
-					slog.Error(errConv.Error())
-				}
+		slog.Error(err.Error())
+
+		if retryAfter, ok := tooManyRequests(err); ok {
+			if retryAfter >= 0 {
+				time.Sleep(retryAfter)
+				EditMessageMarkdown(chatID, messageID, content, bot, mode)
 			}
 			return
 		}
 
 		editMsg.ParseMode = ""
-		_, err = bot.Send(editMsg)
+		editMsg.Entities = nil
+		err = bot.Edit(editMsg)
 		if err != nil {
 			slog.Error(err.Error())
 		}
 	}
 }
 
+// tooManyRequests reports whether err is Telegram's flood control, and how long to wait before
+// trying again, or a negative duration if the error does not say.
+func tooManyRequests(err error) (time.Duration, bool) {
+	// errMsg = ERROR Too Many Requests: retry after <int>
+	errMsg := err.Error()
+	if !strings.Contains(errMsg, "Too Many Requests") {
+		return 0, false
+	}
+	re := regexp.MustCompile(`retry after (\d+)`)
+	matches := re.FindStringSubmatch(errMsg)
+	if len(matches) > 1 {
+		retryAfter, errConv := strconv.Atoi(matches[1])
+		if errConv == nil {
+			return time.Duration(retryAfter+1) * time.Second, true
+		}
+		slog.Error(errConv.Error())
+	}
+	return -1, true
+}
+
 func IsCommand(msg *botapi.Message) bool {
 	re := regexp.MustCompile(`^/\w+(?:@\w+)?`)
 	return msg.IsCommand() || re.MatchString(msg.Caption)
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// flakyMessenger fails sends with the queued errors before passing them on.
+type flakyMessenger struct {
+	*MemoryMessenger
+	errs []error
+	sent []botapi.MessageConfig
+}
+
+func (f *flakyMessenger) Send(msg botapi.MessageConfig) (botapi.Message, error) {
+	f.sent = append(f.sent, msg)
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return botapi.Message{}, err
+	}
+	return f.MemoryMessenger.Send(msg)
+}
+
+func TestSendMessageMarkdownRetriesAfterFloodControl(t *testing.T) {
+	bot := &flakyMessenger{MemoryMessenger: NewMemoryMessenger(), errs: []error{errors.New("Too Many Requests: retry after 0")}}
+	sent, err := SendMessageMarkdown(1, "*hi*", bot, RenderModeMarkdownV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bot.sent) != 2 || bot.sent[1].ParseMode != botapi.ModeMarkdownV2 {
+		t.Errorf("sends = %+v, want the formatted message sent again", bot.sent)
+	}
+	if sent.MessageID == 0 {
+		t.Errorf("sent = %+v, want the delivered message", sent)
+	}
+}
+
+func TestSendMessageMarkdownFallsBackToPlainText(t *testing.T) {
+	bot := &flakyMessenger{MemoryMessenger: NewMemoryMessenger(), errs: []error{errors.New("Bad Request: can't parse entities")}}
+	if _, err := SendMessageMarkdown(1, "*hi*", bot, RenderModeMarkdownV2); err != nil {
+		t.Fatal(err)
+	}
+	if len(bot.sent) != 2 || bot.sent[1].ParseMode != "" {
+		t.Errorf("sends = %+v, want the message sent again without formatting", bot.sent)
+	}
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	ChatRoleUser      = "user"
+	ChatRoleAssistant = "assistant"
+)
+
+type ChatPartType int
+
+const (
+	ChatPartText ChatPartType = iota
+	ChatPartImage
+	ChatPartAudio // only sent by OpenAI chat completions, see AcceptsAudio
+)
+
+// ChatPart is one piece of a multimodal message. Binary parts carry their raw bytes.
+type ChatPart struct {
+	Type ChatPartType
+	Text string
+	Data []byte
+}
+
+type ChatMessage struct {
+	Role  string
+	Parts []ChatPart
+}
+
+// ChatRequest is a provider-neutral chat completion request.
+type ChatRequest struct {
+	Model         string
+	API           string // API of the provider to use, e.g. "responses" for OpenAI
+	SystemPrompt  string
+	DeveloperRole bool // send the system prompt with the developer role instead, for chat completions
+	Messages      []ChatMessage
+	MaxTokens     int
+	Temperature   *float32 // nil if the model does not support temperature
+}
+
+type ChatUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+type ChatResponse struct {
+	Content      string
+	FinishReason string
+	Usage        *ChatUsage // nil if not reported
+}
+
+// ChatDelta is one increment of a streamed response. Usage is usually only set on the last one.
+type ChatDelta struct {
+	Content      string
+	FinishReason string
+	Usage        *ChatUsage
+}
+
+// ChatStream yields deltas until Recv returns io.EOF.
+type ChatStream interface {
+	Recv() (ChatDelta, error)
+	Close() error
+}
+
+// ChatBackend is an LLM API capable of chat completions.
+type ChatBackend interface {
+	CreateChat(ctx context.Context, req ChatRequest) (ChatResponse, error)
+	CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error)
+}
+
+func NewTextMessage(role string, content string) ChatMessage {
+	return ChatMessage{Role: role, Parts: []ChatPart{{Type: ChatPartText, Text: content}}}
+}
+
+// NewChatBackend creates the backend matching the provider type.
+func NewChatBackend(provider Provider) (ChatBackend, error) {
+	switch provider.Type {
+	case "", ProviderTypeOpenAI:
+		return newOpenAIBackend(provider)
+	case ProviderTypeAnthropic:
+		return newAnthropicBackend(provider)
+	default:
+		return nil, fmt.Errorf("unknown provider type: %s", provider.Type)
+	}
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -12,19 +14,46 @@ const (
 	ConfigType = "toml"
 )
 
+const (
+	ProviderTypeOpenAI    = "openai"
+	ProviderTypeAnthropic = "anthropic"
+)
+
+// Policies for messages that arrive while a reply is being generated.
+const (
+	QueuePolicyReject    = "reject"    // drop the message and tell the user
+	QueuePolicyQueue     = "queue"     // answer queued messages one by one, in order
+	QueuePolicyMerge     = "merge"     // answer all queued messages as a single user turn
+	QueuePolicyInterrupt = "interrupt" // stop the current reply and answer the new message instead
+)
+
 type Provider struct {
-	Name    string
-	BaseURL string
-	APIKey  string
+	Name        string
+	Type        string // API flavor of the provider, defaults to "openai"
+	BaseURL     string
+	APIKey      string
+	AuthType    string            // "bearer" (default), "azure" or "none"
+	APIVersion  string            // api-version query parameter for Azure, must serve the Responses API if a model uses it
+	Deployments map[string]string // map of model name to Azure deployment name
+	Headers     map[string]string // static headers added to every request
+	Proxy       string            // HTTP or SOCKS5 proxy URL
 }
 
 type Model struct {
-	Alias        string
-	Name         string
-	Provider     string
-	Stream       bool
-	SystemPrompt bool
-	Temperature  bool
+	Alias         string
+	Name          string
+	Provider      string
+	API           string // "responses" to use the OpenAI Responses API instead of chat completions
+	Stream        bool
+	SystemPrompt  bool
+	Temperature   bool
+	MaxRetries    int      // retries on 429 and 5xx responses
+	RetryDelay    int      // initial retry backoff in milliseconds, doubled on every retry
+	Timeout       int      // request timeout in seconds, 0 for none
+	ContextWindow int      // context size in tokens, history is trimmed to fit; 0 for no limit
+	TextOnly      bool     // the model cannot see images, which are left out of requests
+	AudioInput    bool     // audio the model accepts is passed to it instead of being transcribed, see util.AcceptsAudio
+	Fallbacks     []string // aliases of models to try in order when this one fails
 }
 
 type Rejection struct {
@@ -52,8 +81,19 @@ type Config struct {
 	DefaultTemperature    float32
 	DefaultSystemPrompt   string
 	MaxTokensPerResponse  int
-	MaxChatRecordsPerUser int
+	MaxChatRecordsPerUser int // records kept per session for models without a ContextWindow
 	UseTelegramify        bool
+	UseEntities           bool     // send formatting as message entities instead of MarkdownV2
+	QueuePolicy           string   // what to do with messages sent while responding, see QueuePolicyReject
+	DebounceWindow        int      // milliseconds to wait for more messages before answering, 0 to answer at once
+	SummaryModel          string   // alias of the model that summarizes old history, empty to simply drop it
+	TranscriptionModel    string   // alias of the speech-to-text model for voice messages, on an OpenAI provider
+	SpeechModel           string   // alias of the text-to-speech model for /speak and voice replies, on an OpenAI provider
+	SpeechVoice           string   // voice of the text-to-speech model
+	MaxImagesPerRequest   int      // most recent images from history sent with a request
+	DocumentTypes         []string // MIME types of files that are read into a turn, e.g. "text/*"
+	MaxDocumentSize       int      // largest file that is read, in bytes
+	MaxDocumentLength     int      // characters of a file's text kept in a turn, the rest is cut off
 	Debug                 bool
 }
 
@@ -61,6 +101,18 @@ func GetDataDir() string {
 	return os.Getenv("ICHIGOD_DATA_DIR")
 }
 
+// Validate rejects settings that would otherwise be silently treated as something else.
+// Settings left empty take their defaults in LoadConfig.
+func (c *Config) Validate() error {
+	switch c.QueuePolicy {
+	case "", QueuePolicyReject, QueuePolicyQueue, QueuePolicyMerge, QueuePolicyInterrupt:
+	default:
+		return fmt.Errorf("unknown queue policy %q, want one of %s, %s, %s or %s",
+			c.QueuePolicy, QueuePolicyReject, QueuePolicyQueue, QueuePolicyMerge, QueuePolicyInterrupt)
+	}
+	return nil
+}
+
 func LoadConfig() (config Config, err error) {
 	dataDir := GetDataDir()
 	slog.Debug("loading configuration", "data_dir", dataDir)
@@ -79,6 +131,13 @@ func LoadConfig() (config Config, err error) {
 	viper.SetDefault("MaxTokensPerResponse", 4000)
 	viper.SetDefault("MaxChatRecordsPerUser", 32)
 	viper.SetDefault("UseTelegramify", true)
+	viper.SetDefault("UseEntities", false)
+	viper.SetDefault("QueuePolicy", QueuePolicyReject)
+	viper.SetDefault("MaxImagesPerRequest", 4)
+	viper.SetDefault("DocumentTypes", []string{"text/*", "application/json", MIMETypePDF})
+	viper.SetDefault("MaxDocumentSize", 5<<20)
+	viper.SetDefault("MaxDocumentLength", 100000)
+	viper.SetDefault("SpeechVoice", "alloy")
 	viper.SetDefault("Debug", false)
 
 	if err = viper.ReadInConfig(); err != nil {
@@ -90,6 +149,10 @@ func LoadConfig() (config Config, err error) {
 		slog.Error("failed to unmarshal config", "error", err)
 		return
 	}
+	if err = config.Validate(); err != nil {
+		slog.Error("invalid config", "error", err)
+		return
+	}
 
 	slog.Debug("configuration loaded",
 		"admins", len(config.Admins),
@@ -111,3 +174,20 @@ func (c *Config) GetProviderByName(name string) *Provider {
 	}
 	return nil
 }
+
+func (m *Model) RetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: m.MaxRetries,
+		BaseDelay:  time.Duration(m.RetryDelay) * time.Millisecond,
+	}
+}
+
+func (c *Config) RenderMode() RenderMode {
+	if c.UseEntities {
+		return RenderModeEntities
+	}
+	if c.UseTelegramify {
+		return RenderModeMarkdownV2
+	}
+	return RenderModeEscaped
+}
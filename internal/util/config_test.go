@@ -0,0 +1,16 @@
+package util
+
+import "testing"
+
+func TestConfigValidateQueuePolicy(t *testing.T) {
+	for _, policy := range []string{"", QueuePolicyReject, QueuePolicyQueue, QueuePolicyMerge, QueuePolicyInterrupt} {
+		config := Config{QueuePolicy: policy}
+		if err := config.Validate(); err != nil {
+			t.Errorf("Validate() with queue policy %q = %v, want nil", policy, err)
+		}
+	}
+	config := Config{QueuePolicy: "queued"}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted an unknown queue policy")
+	}
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	MIMETypePDF    = "application/pdf"
+	MIMETypeSource = "text/x-source" // any programming language, whatever the client reported
+)
+
+var errNotText = errors.New("file is not valid UTF-8 text")
+
+// documentExtensions maps well-known extensions to a MIME type. Clients often report source code
+// and Markdown as application/octet-stream, so the extension is trusted first.
+var documentExtensions = map[string]string{
+	".txt":      "text/plain",
+	".log":      "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".tsv":      "text/tab-separated-values",
+	".json":     "application/json",
+	".pdf":      MIMETypePDF,
+}
+
+var sourceExtensions = []string{
+	".c", ".h", ".cc", ".cpp", ".hpp", ".cs", ".go", ".java", ".kt", ".swift", ".rs", ".py", ".rb",
+	".php", ".js", ".jsx", ".ts", ".tsx", ".mjs", ".lua", ".pl", ".r", ".scala", ".dart", ".zig",
+	".sh", ".bash", ".zsh", ".ps1", ".sql", ".html", ".css", ".scss", ".xml", ".yaml", ".yml",
+	".toml", ".ini", ".proto", ".vue", ".svelte", ".ex", ".exs", ".hs", ".ml", ".clj", ".vim",
+}
+
+// DocumentMIMEType returns the MIME type of an uploaded file, preferring its extension
+// over the type reported by the client.
+func DocumentMIMEType(fileName string, reported string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if mimeType, ok := documentExtensions[ext]; ok {
+		return mimeType
+	}
+	for _, sourceExt := range sourceExtensions {
+		if ext == sourceExt {
+			return MIMETypeSource
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(reported); err == nil {
+		return mediaType
+	}
+	return "application/octet-stream"
+}
+
+// MatchMIMEType reports whether mimeType matches one of patterns, which may end with a wildcard such as "text/*".
+func MatchMIMEType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mimeType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractDocumentText converts a file to plain text. PDF text is extracted page by page,
+// and everything else has to be UTF-8 text already.
+func ExtractDocumentText(data []byte, mimeType string) (string, error) {
+	if mimeType == MIMETypePDF {
+		return extractPDFText(data)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", errNotText
+	}
+	return string(data), nil
+}
+
+func extractPDFText(data []byte) (text string, err error) {
+	// The parser panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	content, err := io.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	text = strings.TrimSpace(string(content))
+	if text == "" {
+		return "", errors.New("no text found in PDF")
+	}
+	return text, nil
+}
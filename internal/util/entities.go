@@ -0,0 +1,197 @@
+package util
+
+import (
+	"sort"
+	"strings"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+)
+
+// RenderEntities converts Markdown into plain text plus message entities with UTF-16 offsets.
+// Unlike MarkdownV2, the result never needs escaping and cannot be rejected by Telegram's parser.
+func RenderEntities(content string) (string, []botapi.MessageEntity) {
+	doc, source := parseMarkdown(content)
+	r := &entityRenderer{source: source}
+	r.renderBlocks(doc, "\n\n")
+
+	text := strings.TrimRight(r.sb.String(), "\n ")
+	length := UTF16Len(text)
+	entities := make([]botapi.MessageEntity, 0, len(r.entities))
+	for _, entity := range r.entities {
+		if entity.Offset >= length {
+			continue
+		}
+		entity.Length = min(entity.Length, length-entity.Offset)
+		entities = append(entities, entity)
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length
+	})
+	return text, entities
+}
+
+type entityRenderer struct {
+	source   []byte
+	sb       strings.Builder
+	offset   int    // current length of sb in UTF-16 code units
+	indent   string // written after every line break inside list items
+	depth    int    // list nesting depth
+	entities []botapi.MessageEntity
+}
+
+func (r *entityRenderer) write(content string) {
+	if r.indent != "" && strings.Contains(content, "\n") {
+		// Blank lines inside content, like those between the items of a loose list, stay empty.
+		lines := strings.Split(content, "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" || i == len(lines)-1 {
+				lines[i] = r.indent + lines[i]
+			}
+		}
+		content = strings.Join(lines, "\n")
+	}
+	r.sb.WriteString(content)
+	r.offset += UTF16Len(content)
+}
+
+// wrap records an entity of the given type spanning everything written by render.
+func (r *entityRenderer) wrap(entity botapi.MessageEntity, render func()) {
+	start := r.offset
+	render()
+	if r.offset > start {
+		entity.Offset = start
+		entity.Length = r.offset - start
+		r.entities = append(r.entities, entity)
+	}
+}
+
+// wrapLink only emits a text_link for absolute URLs, since Telegram rejects anything else.
+func (r *entityRenderer) wrapLink(url string, render func()) {
+	if !strings.Contains(url, "://") {
+		render()
+		return
+	}
+	r.wrap(botapi.MessageEntity{Type: "text_link", URL: url}, render)
+}
+
+func (r *entityRenderer) renderBlocks(parent ast.Node, sep string) {
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		if child != parent.FirstChild() {
+			r.write(sep)
+		}
+		r.renderBlock(child)
+	}
+}
+
+func (r *entityRenderer) renderBlock(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		r.renderInlines(n)
+	case *ast.Heading:
+		r.wrap(botapi.MessageEntity{Type: "bold"}, func() { r.renderInlines(n) })
+	case *ast.ThematicBreak:
+		r.write(thematicBreak)
+	case *ast.FencedCodeBlock:
+		code := strings.TrimSuffix(blockLines(n, r.source), "\n")
+		r.wrap(botapi.MessageEntity{Type: "pre", Language: string(n.Language(r.source))}, func() { r.write(code) })
+	case *ast.CodeBlock:
+		code := strings.TrimSuffix(blockLines(n, r.source), "\n")
+		r.wrap(botapi.MessageEntity{Type: "pre"}, func() { r.write(code) })
+	case *ast.HTMLBlock:
+		r.write(strings.TrimRight(blockLines(n, r.source), "\n"))
+	case *ast.Blockquote:
+		r.wrap(botapi.MessageEntity{Type: "blockquote"}, func() { r.renderBlocks(n, "\n\n") })
+	case *ast.List:
+		r.renderList(n)
+	case *east.Table:
+		table := strings.TrimSuffix(formatTable(n, r.source), "\n")
+		r.wrap(botapi.MessageEntity{Type: "pre"}, func() { r.write(table) })
+	default:
+		if child := node.FirstChild(); child != nil && child.Type() == ast.TypeBlock {
+			r.renderBlocks(node, "\n\n")
+		} else {
+			r.renderInlines(node)
+		}
+	}
+}
+
+func (r *entityRenderer) renderList(list *ast.List) {
+	sep := "\n\n"
+	if list.IsTight {
+		sep = "\n"
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	number := list.Start
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		if item != list.FirstChild() {
+			r.write(sep)
+		}
+		marker := listMarker(list, number, r.depth)
+		number++
+		r.write(marker + " ")
+
+		parentIndent := r.indent
+		r.indent += strings.Repeat(" ", len([]rune(marker))+1)
+		r.renderBlocks(item, sep)
+		r.indent = parentIndent
+	}
+}
+
+func (r *entityRenderer) renderInlines(parent ast.Node) {
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		r.renderInline(child)
+	}
+}
+
+func (r *entityRenderer) renderInline(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Text:
+		r.write(textValue(n, r.source))
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			r.write("\n")
+		}
+	case *ast.String:
+		r.write(string(n.Value))
+	case *ast.CodeSpan:
+		r.wrap(botapi.MessageEntity{Type: "code"}, func() { r.write(plainText(n, r.source)) })
+	case *ast.Emphasis:
+		entityType := "italic"
+		if n.Level >= 2 {
+			entityType = "bold"
+		}
+		r.wrap(botapi.MessageEntity{Type: entityType}, func() { r.renderInlines(n) })
+	case *east.Strikethrough:
+		r.wrap(botapi.MessageEntity{Type: "strikethrough"}, func() { r.renderInlines(n) })
+	case *ast.Link:
+		r.wrapLink(string(n.Destination), func() {
+			if n.FirstChild() == nil {
+				r.write(string(n.Destination))
+			}
+			r.renderInlines(n)
+		})
+	case *ast.Image:
+		label := plainText(n, r.source)
+		if label == "" {
+			label = "image"
+		}
+		r.wrapLink(string(n.Destination), func() { r.write(label) })
+	case *ast.AutoLink:
+		r.write(string(n.Label(r.source)))
+	case *ast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			r.write(string(segment.Value(r.source)))
+		}
+	case *east.TaskCheckBox:
+		r.write(taskCheckBox(n))
+	default:
+		r.renderInlines(n)
+	}
+}
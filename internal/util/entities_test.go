@@ -0,0 +1,91 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRenderEntities(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		text     string
+		entities []botapi.MessageEntity
+	}{
+		{
+			name:     "emoji before entity",
+			in:       "😀 **bold** after",
+			text:     "😀 bold after",
+			entities: []botapi.MessageEntity{{Type: "bold", Offset: 3, Length: 4}},
+		},
+		{
+			name:     "astral characters before code span",
+			in:       "🍓🍓 `code`",
+			text:     "🍓🍓 code",
+			entities: []botapi.MessageEntity{{Type: "code", Offset: 5, Length: 4}},
+		},
+		{
+			name: "nested bold and italic",
+			in:   "***both*** and **bold _italic_ bold**",
+			text: "both and bold italic bold",
+			entities: []botapi.MessageEntity{
+				{Type: "bold", Offset: 0, Length: 4},
+				{Type: "italic", Offset: 0, Length: 4},
+				{Type: "bold", Offset: 9, Length: 16},
+				{Type: "italic", Offset: 14, Length: 6},
+			},
+		},
+		{
+			name:     "only absolute links",
+			in:       "[site](https://example.com/a) and [rel](/path) and [mail](mailto:x)",
+			text:     "site and rel and mail",
+			entities: []botapi.MessageEntity{{Type: "text_link", Offset: 0, Length: 4, URL: "https://example.com/a"}},
+		},
+		{
+			name:     "code block with language",
+			in:       "```go\nfmt.Println(\"😀\")\n```",
+			text:     "fmt.Println(\"😀\")",
+			entities: []botapi.MessageEntity{{Type: "pre", Offset: 0, Length: 17, Language: "go"}},
+		},
+		{
+			name: "blockquote",
+			in:   "> quoted **bold**\n> more",
+			text: "quoted bold\nmore",
+			entities: []botapi.MessageEntity{
+				{Type: "blockquote", Offset: 0, Length: 16},
+				{Type: "bold", Offset: 7, Length: 4},
+			},
+		},
+		{
+			name:     "nested lists",
+			in:       "- one\n  - two **b**\n- three",
+			text:     "• one\n  ◦ two b\n• three",
+			entities: []botapi.MessageEntity{{Type: "bold", Offset: 14, Length: 1}},
+		},
+		{
+			name:     "loose list leaves blank lines empty",
+			in:       "- one\n\n- two\n\n  para",
+			text:     "• one\n\n• two\n\n  para",
+			entities: []botapi.MessageEntity{},
+		},
+		{
+			name:     "heading",
+			in:       "# Title\n\ntext",
+			text:     "Title\n\ntext",
+			entities: []botapi.MessageEntity{{Type: "bold", Offset: 0, Length: 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities := RenderEntities(tt.in)
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("entities = %+v, want %+v", entities, tt.entities)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuthTypeBearer = "bearer"
+	AuthTypeAzure  = "azure"
+	AuthTypeNone   = "none"
+
+	azureDefaultAPIVersion = "2024-10-21"
+	// The Responses API is only served by preview versions on Azure.
+	azureResponsesAPIVersion = "2025-04-01-preview"
+)
+
+// headerTransport adds static headers to every request.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newProviderHTTPClient builds the HTTP client for a provider, honouring its proxy and custom headers.
+// Requests are retried when their context carries a RetryPolicy.
+func newProviderHTTPClient(provider Provider) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if provider.Proxy != "" {
+		proxyURL, err := url.Parse(provider.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL for provider %s: %w", provider.Name, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme for provider %s: %s", provider.Name, proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if len(provider.Headers) > 0 {
+		roundTripper = &headerTransport{base: transport, headers: provider.Headers}
+	}
+	return &http.Client{Transport: &retryTransport{base: roundTripper}}, nil
+}
+
+// DeploymentFor returns the deployment name configured for a model, or the model name itself.
+// Configuration keys are case-insensitive, so the lookup is too.
+func (p *Provider) DeploymentFor(model string) string {
+	if deployment, ok := p.Deployments[strings.ToLower(model)]; ok {
+		return deployment
+	}
+	if deployment, ok := p.Deployments[model]; ok {
+		return deployment
+	}
+	return model
+}
+
+// azureAPIVersion returns the configured api-version, or fallback if there is none.
+func (p *Provider) azureAPIVersion(fallback string) string {
+	if p.APIVersion != "" {
+		return p.APIVersion
+	}
+	return fallback
+}
+
+// RetryPolicy controls how requests are retried on 429 and 5xx responses, and on connection
+// failures that happen before anything was sent.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration // doubled after every attempt unless the server sends Retry-After
+}
+
+type retryPolicyKey struct{}
+
+const (
+	retryMaxDelay        = 30 * time.Second
+	retryMaxServerDelay  = 2 * time.Minute
+	retryDefaultBaseTime = time.Second
+)
+
+// WithRetryPolicy attaches a retry policy to the requests made with ctx.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+// retryTransport retries requests according to the RetryPolicy found in their context.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy, ok := req.Context().Value(retryPolicyKey{}).(RetryPolicy)
+	if !ok || policy.MaxRetries <= 0 || (req.Body != nil && req.GetBody == nil) {
+		return t.base.RoundTrip(req)
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = retryDefaultBaseTime
+	}
+
+	delay := policy.BaseDelay
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= policy.MaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		wait := delay
+		if err == nil {
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return resp, nil
+			}
+			wait = retryWait(resp, delay)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Warn("retrying request", "url", req.URL.Redacted(), "status", resp.StatusCode, "attempt", attempt+1, "wait", wait)
+		} else if !neverSent(err) {
+			// The server may have acted on the request already.
+			return resp, err
+		} else {
+			slog.Warn("retrying request", "url", req.URL.Redacted(), "error", err, "attempt", attempt+1, "wait", wait)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// retryWait returns how long to wait before retrying after resp, preferring the server's Retry-After.
+func retryWait(resp *http.Response, delay time.Duration) time.Duration {
+	if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		return min(retryAfter, retryMaxServerDelay)
+	}
+	return delay
+}
+
+// neverSent reports whether err shows that the request did not reach the server,
+// as it failed to resolve or connect, so that it is safe to send again.
+func neverSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header: seconds and an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,133 @@
+package util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransportHonoursRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("attempt %d body = %q, want the payload replayed", attempts.Load()+1, body)
+		}
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	client, err := newProviderHTTPClient(Provider{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A base delay this long would time the test out, so the server's Retry-After must win.
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxRetries: 2, BaseDelay: time.Hour})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 2 {
+		t.Errorf("status = %d after %d attempts, want 200 after 2", resp.StatusCode, attempts.Load())
+	}
+}
+
+// A connection dropped after the request was sent is not retried, as the server may have acted on it.
+func TestRetryTransportKeepsSentRequests(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	client, err := newProviderHTTPClient(Provider{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("Do() succeeded, want the connection error")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("server saw %d attempts, want 1", n)
+	}
+}
+
+func TestRetryTransportRetriesFailedDials(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	var attempts atomic.Int32
+	client := &http.Client{Transport: &retryTransport{base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		return http.DefaultTransport.RoundTrip(req)
+	})}}
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("Do() succeeded, want the dial error")
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRetryWait(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name, retryAfter string
+		want             time.Duration
+	}{
+		{"no header", "", 5 * time.Second},
+		{"seconds", "7", 7 * time.Second},
+		{"capped", "3600", retryMaxServerDelay},
+		{"date capped", date, retryMaxServerDelay},
+		{"invalid", "soon", 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			if got := retryWait(resp, 5*time.Second); got != tt.want {
+				t.Errorf("retryWait(Retry-After: %q) = %v, want %v", tt.retryAfter, got, tt.want)
+			}
+		})
+	}
+}
@@ -7,12 +7,21 @@ import (
 	"strings"
 )
 
-// EncodeImageToBase64 converts image bytes to a base64 string with proper content type header
-func EncodeImageToBase64(imageBytes []byte) (string, error) {
+// DetectImageType returns the MIME type of image bytes, or an error if they are not an image
+func DetectImageType(imageBytes []byte) (string, error) {
 	contentType := http.DetectContentType(imageBytes)
 	if !strings.HasPrefix(contentType, "image/") {
 		return "", fmt.Errorf("invalid image content type: %s", contentType)
 	}
+	return contentType, nil
+}
+
+// EncodeImageToBase64 converts image bytes to a base64 string with proper content type header
+func EncodeImageToBase64(imageBytes []byte) (string, error) {
+	contentType, err := DetectImageType(imageBytes)
+	if err != nil {
+		return "", err
+	}
 	base64Str := base64.StdEncoding.EncodeToString(imageBytes)
 	return fmt.Sprintf("data:%s;base64,%s", contentType, base64Str), nil
 }
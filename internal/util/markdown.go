@@ -0,0 +1,366 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	gmutil "github.com/yuin/goldmark/util"
+)
+
+const thematicBreak = "──────────"
+
+var markdownParser = goldmark.New(
+	goldmark.WithExtensions(extension.Table, extension.Strikethrough, extension.TaskList),
+).Parser()
+
+func parseMarkdown(content string) (ast.Node, []byte) {
+	source := []byte(content)
+	return markdownParser.Parse(text.NewReader(source)), source
+}
+
+// RenderMarkdownV2 converts CommonMark (plus GFM tables, strikethrough and task lists)
+// into Telegram MarkdownV2. The output is always correctly escaped.
+func RenderMarkdownV2(content string) string {
+	doc, source := parseMarkdown(content)
+	r := &markdownV2Renderer{source: source}
+	return strings.TrimRight(r.renderBlocks(doc, "\n\n"), "\n")
+}
+
+type markdownV2Renderer struct {
+	source []byte
+	depth  int // list nesting depth
+	bold   bool
+	italic bool
+	strike bool
+}
+
+func (r *markdownV2Renderer) renderBlocks(parent ast.Node, sep string) string {
+	blocks := make([]string, 0, parent.ChildCount())
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		blocks = append(blocks, r.renderBlock(child))
+	}
+	return strings.Join(blocks, sep)
+}
+
+func (r *markdownV2Renderer) renderBlock(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return r.renderInlines(n)
+	case *ast.Heading:
+		if r.bold {
+			return r.renderInlines(n)
+		}
+		r.bold = true
+		content := r.renderInlines(n)
+		r.bold = false
+		return "*" + content + "*"
+	case *ast.ThematicBreak:
+		return thematicBreak
+	case *ast.FencedCodeBlock:
+		return "```" + escapeMarkdownV2Code(string(n.Language(r.source))) + "\n" +
+			escapeMarkdownV2Code(blockLines(n, r.source)) + "```"
+	case *ast.CodeBlock:
+		return "```\n" + escapeMarkdownV2Code(blockLines(n, r.source)) + "```"
+	case *ast.HTMLBlock:
+		return escapeMarkdownV2(strings.TrimRight(blockLines(n, r.source), "\n"))
+	case *ast.Blockquote:
+		lines := strings.Split(r.renderBlocks(n, "\n\n"), "\n")
+		for i, line := range lines {
+			lines[i] = ">" + line
+		}
+		return strings.Join(lines, "\n")
+	case *ast.List:
+		return r.renderList(n)
+	case *east.Table:
+		return "```\n" + escapeMarkdownV2Code(formatTable(n, r.source)) + "```"
+	default:
+		if child := node.FirstChild(); child != nil && child.Type() == ast.TypeBlock {
+			return r.renderBlocks(node, "\n\n")
+		}
+		return r.renderInlines(node)
+	}
+}
+
+func (r *markdownV2Renderer) renderList(list *ast.List) string {
+	sep := "\n\n"
+	if list.IsTight {
+		sep = "\n"
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	items := make([]string, 0, list.ChildCount())
+	number := list.Start
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		marker := listMarker(list, number, r.depth)
+		number++
+		content := r.renderBlocks(item, sep)
+		items = append(items, indentListItem(escapeMarkdownV2(marker), len([]rune(marker)), content))
+	}
+	return strings.Join(items, sep)
+}
+
+func (r *markdownV2Renderer) renderInlines(parent ast.Node) string {
+	var sb strings.Builder
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		r.renderInline(&sb, child)
+	}
+	return sb.String()
+}
+
+func (r *markdownV2Renderer) renderInline(sb *strings.Builder, node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Text:
+		sb.WriteString(escapeMarkdownV2(textValue(n, r.source)))
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			sb.WriteString("\n")
+		}
+	case *ast.String:
+		sb.WriteString(escapeMarkdownV2(string(n.Value)))
+	case *ast.CodeSpan:
+		sb.WriteString("`" + escapeMarkdownV2Code(plainText(n, r.source)) + "`")
+	case *ast.Emphasis:
+		if n.Level >= 2 {
+			r.wrapInline(sb, n, &r.bold, "*")
+		} else {
+			r.wrapInline(sb, n, &r.italic, "_")
+		}
+	case *east.Strikethrough:
+		r.wrapInline(sb, n, &r.strike, "~")
+	case *ast.Link:
+		label := r.renderInlines(n)
+		if label == "" {
+			label = escapeMarkdownV2(string(n.Destination))
+		}
+		sb.WriteString("[" + label + "](" + escapeMarkdownV2URL(string(n.Destination)) + ")")
+	case *ast.Image:
+		label := escapeMarkdownV2(plainText(n, r.source))
+		if label == "" {
+			label = "image"
+		}
+		sb.WriteString("[" + label + "](" + escapeMarkdownV2URL(string(n.Destination)) + ")")
+	case *ast.AutoLink:
+		sb.WriteString(escapeMarkdownV2(string(n.Label(r.source))))
+	case *ast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			sb.WriteString(escapeMarkdownV2(string(segment.Value(r.source))))
+		}
+	case *east.TaskCheckBox:
+		sb.WriteString(taskCheckBox(n))
+	default:
+		sb.WriteString(r.renderInlines(n))
+	}
+}
+
+// wrapInline surrounds the children of node with marker, unless the same style is already active.
+func (r *markdownV2Renderer) wrapInline(sb *strings.Builder, node ast.Node, active *bool, marker string) {
+	if *active {
+		sb.WriteString(r.renderInlines(node))
+		return
+	}
+	*active = true
+	content := r.renderInlines(node)
+	*active = false
+	if content == "" {
+		return
+	}
+	// Consecutive underscores would be parsed as underline by Telegram.
+	if marker == "_" && strings.HasSuffix(sb.String(), "_") && !strings.HasSuffix(sb.String(), "\\_") {
+		sb.WriteString("\r")
+	}
+	sb.WriteString(marker + content + marker)
+}
+
+func escapeMarkdownV2(content string) string {
+	var sb strings.Builder
+	sb.Grow(len(content))
+	for _, c := range content {
+		if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+func escapeMarkdownV2Code(content string) string {
+	content = strings.ReplaceAll(content, "\\", "\\\\")
+	return strings.ReplaceAll(content, "`", "\\`")
+}
+
+func escapeMarkdownV2URL(content string) string {
+	content = strings.ReplaceAll(content, "\\", "\\\\")
+	return strings.ReplaceAll(content, ")", "\\)")
+}
+
+// textValue returns the literal value of a text node with escapes and entities resolved.
+func textValue(n *ast.Text, source []byte) string {
+	value := n.Value(source)
+	if n.IsRaw() {
+		return string(value)
+	}
+	return string(gmutil.ResolveNumericReferences(gmutil.ResolveEntityNames(gmutil.UnescapePunctuations(value))))
+}
+
+// plainText flattens the inline content of node without any formatting.
+func plainText(node ast.Node, source []byte) string {
+	var sb strings.Builder
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch n := child.(type) {
+		case *ast.Text:
+			sb.WriteString(textValue(n, source))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				sb.WriteString(" ")
+			}
+		case *ast.String:
+			sb.Write(n.Value)
+		case *ast.AutoLink:
+			sb.Write(n.Label(source))
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				segment := n.Segments.At(i)
+				sb.Write(segment.Value(source))
+			}
+		case *east.TaskCheckBox:
+			sb.WriteString(taskCheckBox(n))
+		default:
+			sb.WriteString(plainText(n, source))
+		}
+	}
+	return sb.String()
+}
+
+func blockLines(node ast.Node, source []byte) string {
+	var sb strings.Builder
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		sb.Write(line.Value(source))
+	}
+	content := sb.String()
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content
+}
+
+func taskCheckBox(n *east.TaskCheckBox) string {
+	if n.IsChecked {
+		return "☑ "
+	}
+	return "☐ "
+}
+
+func listMarker(list *ast.List, number int, depth int) string {
+	if list.IsOrdered() {
+		return fmt.Sprintf("%d.", number)
+	}
+	bullets := []string{"•", "◦", "▪"}
+	return bullets[(depth-1)%len(bullets)]
+}
+
+// indentListItem prefixes the first line of content with marker and aligns the rest below it.
+func indentListItem(marker string, markerWidth int, content string) string {
+	indent := strings.Repeat(" ", markerWidth+1)
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = marker + " " + line
+		} else if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatTable lays out a table as aligned plain text for a preformatted block.
+func formatTable(table *east.Table, source []byte) string {
+	var rows [][]string
+	var widths []int
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []string
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			content := strings.TrimSpace(plainText(cell, source))
+			if len(cells) >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[len(cells)] = max(widths[len(cells)], displayWidth(content))
+			cells = append(cells, content)
+		}
+		rows = append(rows, cells)
+	}
+
+	var sb strings.Builder
+	for i, cells := range rows {
+		for j, width := range widths {
+			content := ""
+			if j < len(cells) {
+				content = cells[j]
+			}
+			alignment := east.AlignNone
+			if j < len(table.Alignments) {
+				alignment = table.Alignments[j]
+			}
+			if j > 0 {
+				sb.WriteString(" | ")
+			}
+			sb.WriteString(padCell(content, width, alignment))
+		}
+		sb.WriteString("\n")
+		if i == 0 {
+			for j, width := range widths {
+				if j > 0 {
+					sb.WriteString("-+-")
+				}
+				sb.WriteString(strings.Repeat("-", width))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func padCell(content string, width int, alignment east.Alignment) string {
+	padding := width - displayWidth(content)
+	switch alignment {
+	case east.AlignRight:
+		return strings.Repeat(" ", padding) + content
+	case east.AlignCenter:
+		left := padding / 2
+		return strings.Repeat(" ", left) + content + strings.Repeat(" ", padding-left)
+	default:
+		return content + strings.Repeat(" ", padding)
+	}
+}
+
+// displayWidth approximates the number of monospace columns taken by content.
+func displayWidth(content string) int {
+	width := 0
+	for _, c := range content {
+		if gmutil.IsEastAsianWideRune(c) {
+			width += 2
+		} else {
+			width++
+		}
+	}
+	return width
+}
+
+// UTF16Len returns the length of content in UTF-16 code units, which is how Telegram measures text.
+func UTF16Len(content string) int {
+	length := 0
+	for _, c := range content {
+		if c >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// TestRenderMarkdownV2Golden renders every testdata/markdownv2/*.md file and compares it
+// with the .golden file next to it. Run with -update after an intended change.
+func TestRenderMarkdownV2Golden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "markdownv2", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden inputs found")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := RenderMarkdownV2(string(source))
+			goldenPath := strings.TrimSuffix(input, ".md") + ".golden"
+			if *update {
+				if err := os.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output mismatch\n--- got ---\n%s\n--- want ---\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"reserved", "a_b*c[d]e(f)g~h`i>j#k+l-m=n|o{p}q.r!s\\t", "a\\_b\\*c\\[d\\]e\\(f\\)g\\~h\\`i\\>j\\#k\\+l\\-m\\=n\\|o\\{p\\}q\\.r\\!s\\\\t"},
+		{"unicode", "草莓 1.5!", "草莓 1\\.5\\!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeMarkdownV2(tt.in); got != tt.want {
+				t.Errorf("escapeMarkdownV2(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
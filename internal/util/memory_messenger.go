@@ -0,0 +1,134 @@
+package util
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MemoryMessenger is an in-memory Messenger for exercising the bot without Telegram.
+// Messages it sends are kept in order, edits are applied in place and deleted messages are dropped.
+type MemoryMessenger struct {
+	mu       sync.Mutex
+	nextID   int
+	messages []botapi.Message
+	actions  []botapi.ChatActionConfig
+	files    map[string][]byte
+	updates  chan botapi.Update
+	stopOnce sync.Once
+}
+
+func NewMemoryMessenger() *MemoryMessenger {
+	return &MemoryMessenger{
+		nextID:  1,
+		files:   make(map[string][]byte),
+		updates: make(chan botapi.Update, 64),
+	}
+}
+
+// Push delivers an update to whoever is reading Updates.
+func (m *MemoryMessenger) Push(update botapi.Update) {
+	m.updates <- update
+}
+
+// AddFile makes content downloadable under fileID.
+func (m *MemoryMessenger) AddFile(fileID string, content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[fileID] = content
+}
+
+// Messages returns a snapshot of every message sent so far, with edits applied.
+func (m *MemoryMessenger) Messages() []botapi.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]botapi.Message(nil), m.messages...)
+}
+
+// Actions returns a snapshot of every chat action sent so far.
+func (m *MemoryMessenger) Actions() []botapi.ChatActionConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]botapi.ChatActionConfig(nil), m.actions...)
+}
+
+func (m *MemoryMessenger) Send(msg botapi.MessageConfig) (botapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := botapi.Message{
+		MessageID: m.nextID,
+		Chat:      &botapi.Chat{ID: msg.ChatID},
+		Text:      msg.Text,
+		Entities:  msg.Entities,
+	}
+	m.nextID++
+	m.messages = append(m.messages, sent)
+	return sent, nil
+}
+
+func (m *MemoryMessenger) Edit(edit botapi.EditMessageTextConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].MessageID == edit.MessageID && m.messages[i].Chat.ID == edit.ChatID {
+			m.messages[i].Text = edit.Text
+			m.messages[i].Entities = edit.Entities
+			return nil
+		}
+	}
+	return fmt.Errorf("message %d not found in chat %d", edit.MessageID, edit.ChatID)
+}
+
+func (m *MemoryMessenger) Delete(chatID int64, messageID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.messages {
+		if m.messages[i].MessageID == messageID && m.messages[i].Chat.ID == chatID {
+			m.messages = slices.Delete(m.messages, i, i+1)
+			return nil
+		}
+	}
+	return fmt.Errorf("message %d not found in chat %d", messageID, chatID)
+}
+
+func (m *MemoryMessenger) SendChatAction(chatID int64, action string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.actions = append(m.actions, botapi.NewChatAction(chatID, action))
+	return nil
+}
+
+func (m *MemoryMessenger) SendVoice(voice botapi.VoiceConfig) (botapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := botapi.Message{
+		MessageID: m.nextID,
+		Chat:      &botapi.Chat{ID: voice.ChatID},
+		Voice:     &botapi.Voice{FileID: fmt.Sprintf("voice-%d", m.nextID)},
+		Caption:   voice.Caption,
+	}
+	m.nextID++
+	m.messages = append(m.messages, sent)
+	return sent, nil
+}
+
+func (m *MemoryMessenger) DownloadFile(fileID string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.files[fileID]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found", fileID)
+	}
+	return content, nil
+}
+
+func (m *MemoryMessenger) Updates() <-chan botapi.Update {
+	return m.updates
+}
+
+// Stop closes the update stream, which ends the service loop.
+func (m *MemoryMessenger) Stop() {
+	m.stopOnce.Do(func() { close(m.updates) })
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	botapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Messenger is the chat transport the bot talks through.
+type Messenger interface {
+	Send(msg botapi.MessageConfig) (botapi.Message, error)
+	Edit(edit botapi.EditMessageTextConfig) error
+	Delete(chatID int64, messageID int) error
+	SendChatAction(chatID int64, action string) error
+	SendVoice(voice botapi.VoiceConfig) (botapi.Message, error)
+	DownloadFile(fileID string) ([]byte, error)
+	Updates() <-chan botapi.Update
+	Stop()
+}
+
+// TelegramMessenger implements Messenger with the Telegram Bot API.
+type TelegramMessenger struct {
+	bot     *botapi.BotAPI
+	updates botapi.UpdatesChannel
+}
+
+func NewTelegramMessenger(token string, debug bool) (*TelegramMessenger, error) {
+	bot, err := botapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	bot.Debug = debug
+	slog.Info("bot API client initialized", "username", bot.Self.UserName, "debug_mode", debug)
+
+	u := botapi.NewUpdate(0)
+	u.Timeout = 60
+	return &TelegramMessenger{bot: bot, updates: bot.GetUpdatesChan(u)}, nil
+}
+
+func (t *TelegramMessenger) Send(msg botapi.MessageConfig) (botapi.Message, error) {
+	return t.bot.Send(msg)
+}
+
+func (t *TelegramMessenger) Edit(edit botapi.EditMessageTextConfig) error {
+	_, err := t.bot.Send(edit)
+	return err
+}
+
+func (t *TelegramMessenger) Delete(chatID int64, messageID int) error {
+	_, err := t.bot.Request(botapi.NewDeleteMessage(chatID, messageID))
+	return err
+}
+
+func (t *TelegramMessenger) SendChatAction(chatID int64, action string) error {
+	_, err := t.bot.Request(botapi.NewChatAction(chatID, action))
+	return err
+}
+
+func (t *TelegramMessenger) SendVoice(voice botapi.VoiceConfig) (botapi.Message, error) {
+	return t.bot.Send(voice)
+}
+
+func (t *TelegramMessenger) DownloadFile(fileID string) ([]byte, error) {
+	fileURL, err := t.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (t *TelegramMessenger) Updates() <-chan botapi.Update {
+	return t.updates
+}
+
+func (t *TelegramMessenger) Stop() {
+	t.bot.StopReceivingUpdates()
+}
@@ -1,3 +1,189 @@
 package util
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
 const ChatMessageRoleDeveloper = "developer"
+
+type openAIBackend struct {
+	client     *openai.Client
+	provider   Provider
+	baseURL    string
+	httpClient *http.Client
+}
+
+type openAIStream struct {
+	stream *openai.ChatCompletionStream
+}
+
+func newOpenAIBackend(provider Provider) (*openAIBackend, error) {
+	httpClient, err := newProviderHTTPClient(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientConfig openai.ClientConfig
+	switch provider.AuthType {
+	case "", AuthTypeBearer:
+		clientConfig = openai.DefaultConfig(provider.APIKey)
+		clientConfig.BaseURL = provider.BaseURL
+	case AuthTypeAzure:
+		clientConfig = openai.DefaultAzureConfig(provider.APIKey, provider.BaseURL)
+		clientConfig.APIVersion = provider.azureAPIVersion(azureDefaultAPIVersion)
+		clientConfig.AzureModelMapperFunc = provider.DeploymentFor
+	case AuthTypeNone:
+		clientConfig = openai.DefaultConfig("")
+		clientConfig.BaseURL = provider.BaseURL
+	default:
+		return nil, fmt.Errorf("unknown auth type for provider %s: %s", provider.Name, provider.AuthType)
+	}
+	if clientConfig.BaseURL == "" {
+		clientConfig.BaseURL = openai.DefaultConfig("").BaseURL
+	}
+	clientConfig.HTTPClient = httpClient
+
+	return &openAIBackend{
+		client:     openai.NewClientWithConfig(clientConfig),
+		provider:   provider,
+		baseURL:    strings.TrimSuffix(clientConfig.BaseURL, "/"),
+		httpClient: httpClient,
+	}, nil
+}
+
+func (b *openAIBackend) CreateChat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	if req.API == ModelAPIResponses {
+		return b.createResponse(ctx, req)
+	}
+	if slices.ContainsFunc(req.Messages, hasAudio) {
+		return b.createAudioChat(ctx, req)
+	}
+	openaiReq, err := toOpenAIRequest(req)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	resp, err := b.client.CreateChatCompletion(ctx, openaiReq)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return ChatResponse{}, errors.New("empty response choices")
+	}
+	return ChatResponse{
+		Content:      resp.Choices[0].Message.Content,
+		FinishReason: string(resp.Choices[0].FinishReason),
+		Usage:        fromOpenAIUsage(&resp.Usage),
+	}, nil
+}
+
+func (b *openAIBackend) CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	if req.API == ModelAPIResponses {
+		return b.createResponseStream(ctx, req)
+	}
+	if slices.ContainsFunc(req.Messages, hasAudio) {
+		return b.createAudioChatStream(ctx, req)
+	}
+	openaiReq, err := toOpenAIRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	openaiReq.Stream = true
+	stream, err := b.client.CreateChatCompletionStream(ctx, openaiReq)
+	if err != nil {
+		return nil, err
+	}
+	return &openAIStream{stream: stream}, nil
+}
+
+func (s *openAIStream) Recv() (ChatDelta, error) {
+	resp, err := s.stream.Recv()
+	if err != nil {
+		return ChatDelta{}, err
+	}
+	delta := ChatDelta{Usage: fromOpenAIUsage(resp.Usage)}
+	if len(resp.Choices) > 0 {
+		delta.Content = resp.Choices[0].Delta.Content
+		delta.FinishReason = string(resp.Choices[0].FinishReason)
+	}
+	return delta, nil
+}
+
+func (s *openAIStream) Close() error {
+	return s.stream.Close()
+}
+
+func toOpenAIRequest(req ChatRequest) (openai.ChatCompletionRequest, error) {
+	systemRole := openai.ChatMessageRoleSystem
+	if req.DeveloperRole {
+		systemRole = ChatMessageRoleDeveloper
+	}
+	msgs := make([]openai.ChatCompletionMessage, 0, len(req.Messages)+1)
+	msgs = append(msgs, openai.ChatCompletionMessage{
+		Role:    systemRole,
+		Content: req.SystemPrompt,
+	})
+	for _, msg := range req.Messages {
+		openaiMsg, err := toOpenAIMessage(msg)
+		if err != nil {
+			return openai.ChatCompletionRequest{}, err
+		}
+		msgs = append(msgs, openaiMsg)
+	}
+
+	openaiReq := openai.ChatCompletionRequest{
+		Messages:            msgs,
+		Model:               req.Model,
+		MaxCompletionTokens: req.MaxTokens,
+	}
+	if req.Temperature != nil {
+		openaiReq.Temperature = *req.Temperature
+	}
+	return openaiReq, nil
+}
+
+func toOpenAIMessage(msg ChatMessage) (openai.ChatCompletionMessage, error) {
+	role := openai.ChatMessageRoleAssistant
+	if msg.Role == ChatRoleUser {
+		role = openai.ChatMessageRoleUser
+	}
+	if len(msg.Parts) == 1 && msg.Parts[0].Type == ChatPartText {
+		return openai.ChatCompletionMessage{Role: role, Content: msg.Parts[0].Text}, nil
+	}
+
+	multiContent := make([]openai.ChatMessagePart, 0, len(msg.Parts))
+	for _, part := range msg.Parts {
+		switch part.Type {
+		case ChatPartText:
+			multiContent = append(multiContent, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: part.Text,
+			})
+		case ChatPartImage:
+			base64Image, err := EncodeImageToBase64(part.Data)
+			if err != nil {
+				return openai.ChatCompletionMessage{}, err
+			}
+			multiContent = append(multiContent, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{
+					URL: base64Image,
+				},
+			})
+		}
+	}
+	return openai.ChatCompletionMessage{Role: role, MultiContent: multiContent}, nil
+}
+
+func fromOpenAIUsage(usage *openai.Usage) *ChatUsage {
+	if usage == nil || usage.TotalTokens == 0 {
+		return nil
+	}
+	return &ChatUsage{PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}
+}
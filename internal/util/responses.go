@@ -0,0 +1,270 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const ModelAPIResponses = "responses"
+
+// The OpenAI Responses API (/v1/responses), for models that are not served through chat completions.
+
+type responsesRequest struct {
+	Model           string               `json:"model"`
+	Instructions    string               `json:"instructions,omitempty"`
+	Input           []responsesInputItem `json:"input"`
+	MaxOutputTokens int                  `json:"max_output_tokens,omitempty"`
+	Temperature     *float32             `json:"temperature,omitempty"`
+	Stream          bool                 `json:"stream,omitempty"`
+	Store           bool                 `json:"store"`
+}
+
+type responsesInputItem struct {
+	Role    string             `json:"role"`
+	Content []responsesContent `json:"content"`
+}
+
+type responsesContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+type responsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type responsesError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type responsesResponse struct {
+	Status            string `json:"status"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Output []struct {
+		Type    string             `json:"type"`
+		Content []responsesContent `json:"content"`
+	} `json:"output"`
+	Usage *responsesUsage `json:"usage"`
+	Error *responsesError `json:"error"`
+}
+
+type responsesEvent struct {
+	Type     string            `json:"type"`
+	Delta    string            `json:"delta"`
+	Message  string            `json:"message"`
+	Response responsesResponse `json:"response"`
+}
+
+type responsesStream struct {
+	body   io.ReadCloser
+	events *sseReader
+	done   bool
+}
+
+func (b *openAIBackend) createResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := b.postResponses(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var responsesResp responsesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responsesResp); err != nil {
+		return ChatResponse{}, err
+	}
+	if responsesResp.Error != nil {
+		return ChatResponse{}, fmt.Errorf("responses API error: %s: %s", responsesResp.Error.Code, responsesResp.Error.Message)
+	}
+
+	var content strings.Builder
+	for _, item := range responsesResp.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, part := range item.Content {
+			if part.Type == "output_text" {
+				content.WriteString(part.Text)
+			}
+		}
+	}
+	return ChatResponse{
+		Content:      content.String(),
+		FinishReason: responsesFinishReason(responsesResp),
+		Usage:        fromResponsesUsage(responsesResp.Usage),
+	}, nil
+}
+
+func (b *openAIBackend) createResponseStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	resp, err := b.postResponses(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return &responsesStream{body: resp.Body, events: newSSEReader(resp.Body)}, nil
+}
+
+func (b *openAIBackend) postResponses(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	if b.provider.AuthType == AuthTypeAzure {
+		req.Model = b.provider.DeploymentFor(req.Model)
+	}
+	responsesReq, err := toResponsesRequest(req, stream)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(responsesReq)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.responsesURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	b.authorize(httpReq)
+
+	resp, err := b.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error *responsesError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return nil, fmt.Errorf("responses API error: status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("responses API error: status %d: %s", resp.StatusCode, errResp.Error.Message)
+	}
+	return resp, nil
+}
+
+// authorize sets the credentials of requests that bypass the go-openai client.
+func (b *openAIBackend) authorize(httpReq *http.Request) {
+	switch b.provider.AuthType {
+	case AuthTypeAzure:
+		httpReq.Header.Set(openai.AzureAPIKeyHeader, b.provider.APIKey)
+	case AuthTypeNone:
+	default:
+		httpReq.Header.Set("Authorization", "Bearer "+b.provider.APIKey)
+	}
+}
+
+func (b *openAIBackend) responsesURL() string {
+	if b.provider.AuthType == AuthTypeAzure {
+		return b.baseURL + "/openai/responses?api-version=" + url.QueryEscape(b.provider.azureAPIVersion(azureResponsesAPIVersion))
+	}
+	return b.baseURL + "/responses"
+}
+
+func (s *responsesStream) Recv() (ChatDelta, error) {
+	if s.done {
+		return ChatDelta{}, io.EOF
+	}
+	for {
+		data, err := s.events.Next()
+		if err != nil {
+			return ChatDelta{}, err
+		}
+		if data == "[DONE]" {
+			return ChatDelta{}, io.EOF
+		}
+
+		var event responsesEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return ChatDelta{}, err
+		}
+		switch event.Type {
+		case "response.output_text.delta":
+			if event.Delta != "" {
+				return ChatDelta{Content: event.Delta}, nil
+			}
+		case "response.completed", "response.incomplete":
+			s.done = true
+			return ChatDelta{
+				FinishReason: responsesFinishReason(event.Response),
+				Usage:        fromResponsesUsage(event.Response.Usage),
+			}, nil
+		case "response.failed":
+			if event.Response.Error != nil {
+				return ChatDelta{}, fmt.Errorf("responses stream error: %s: %s", event.Response.Error.Code, event.Response.Error.Message)
+			}
+			return ChatDelta{}, fmt.Errorf("responses stream failed")
+		case "error":
+			return ChatDelta{}, fmt.Errorf("responses stream error: %s", event.Message)
+		}
+	}
+}
+
+func (s *responsesStream) Close() error {
+	return s.body.Close()
+}
+
+// toResponsesRequest passes the system prompt as instructions, which suit every model behind the
+// Responses API whatever role it expects. Audio is left out, see AcceptsAudio.
+func toResponsesRequest(req ChatRequest, stream bool) (responsesRequest, error) {
+	input := make([]responsesInputItem, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		item := responsesInputItem{Role: ChatRoleUser}
+		textType := "input_text"
+		if msg.Role != ChatRoleUser {
+			item.Role = ChatRoleAssistant
+			textType = "output_text"
+		}
+		for _, part := range msg.Parts {
+			switch part.Type {
+			case ChatPartText:
+				if part.Text != "" {
+					item.Content = append(item.Content, responsesContent{Type: textType, Text: part.Text})
+				}
+			case ChatPartImage:
+				base64Image, err := EncodeImageToBase64(part.Data)
+				if err != nil {
+					return responsesRequest{}, err
+				}
+				item.Content = append(item.Content, responsesContent{Type: "input_image", ImageURL: base64Image})
+			}
+		}
+		if len(item.Content) > 0 {
+			input = append(input, item)
+		}
+	}
+
+	return responsesRequest{
+		Model:           req.Model,
+		Instructions:    req.SystemPrompt,
+		Input:           input,
+		MaxOutputTokens: req.MaxTokens,
+		Temperature:     req.Temperature,
+		Stream:          stream,
+	}, nil
+}
+
+func responsesFinishReason(resp responsesResponse) string {
+	if resp.Status == "incomplete" && resp.IncompleteDetails != nil && resp.IncompleteDetails.Reason == "max_output_tokens" {
+		return "length"
+	}
+	if resp.Status == "completed" {
+		return "stop"
+	}
+	return resp.Status
+}
+
+func fromResponsesUsage(usage *responsesUsage) *ChatUsage {
+	if usage == nil {
+		return nil
+	}
+	return &ChatUsage{PromptTokens: usage.InputTokens, CompletionTokens: usage.OutputTokens}
+}
@@ -0,0 +1,221 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newResponsesTestBackend serves handler as the Responses API and records the decoded requests.
+func newResponsesTestBackend(t *testing.T, handler http.HandlerFunc) (ChatBackend, *[]responsesRequest) {
+	t.Helper()
+	var requests []responsesRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/responses" {
+			t.Errorf("request path = %s, want /responses", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q, want Bearer test-key", got)
+		}
+		var req responsesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		requests = append(requests, req)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	backend, err := NewChatBackend(Provider{Name: "test", Type: ProviderTypeOpenAI, BaseURL: server.URL, APIKey: "test-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, &requests
+}
+
+func testResponsesRequest() ChatRequest {
+	req := testChatRequest()
+	req.Model = "gpt-test"
+	req.API = ModelAPIResponses
+	req.DeveloperRole = true
+	req.Messages = append(req.Messages, ChatMessage{Role: ChatRoleUser, Parts: []ChatPart{{Type: ChatPartAudio, Data: testWAV}}})
+	return req
+}
+
+func TestResponsesCreateChat(t *testing.T) {
+	backend, requests := newResponsesTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"completed","output":[{"type":"reasoning"},{"type":"message","content":[{"type":"output_text","text":"A "},{"type":"output_text","text":"picture."}]}],"usage":{"input_tokens":12,"output_tokens":3}}`)
+	})
+
+	resp, err := backend.CreateChat(context.Background(), testResponsesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "A picture." || resp.FinishReason != "stop" {
+		t.Errorf("response = %+v, want content %q and finish reason stop", resp, "A picture.")
+	}
+	if resp.Usage == nil || resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 3 {
+		t.Errorf("usage = %+v, want 12 prompt and 3 completion tokens", resp.Usage)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*requests))
+	}
+	req := (*requests)[0]
+	if req.Instructions != "Be brief." || req.Stream || req.MaxOutputTokens != 100 || req.Store {
+		t.Errorf("request = %+v, want the instructions, max output tokens, no streaming and no storage", req)
+	}
+	if req.Temperature == nil || *req.Temperature != 0.5 {
+		t.Errorf("temperature = %v, want 0.5", req.Temperature)
+	}
+	// The audio-only message has nothing the Responses API takes, so it is left out.
+	if len(req.Input) != 3 {
+		t.Fatalf("input = %+v, want assistant, user and user items", req.Input)
+	}
+	if req.Input[0].Role != "assistant" || req.Input[0].Content[0].Type != "output_text" {
+		t.Errorf("first item = %+v, want assistant output text", req.Input[0])
+	}
+	content := req.Input[1].Content
+	if req.Input[1].Role != "user" || len(content) != 2 || content[0].Type != "input_text" || content[0].Text != "What is this?" {
+		t.Fatalf("second item = %+v, want user text and image", req.Input[1])
+	}
+	if content[1].Type != "input_image" || !strings.HasPrefix(content[1].ImageURL, "data:image/png;base64,") {
+		t.Errorf("image part = %+v, want a PNG data URL", content[1])
+	}
+}
+
+func TestResponsesCreateChatIncomplete(t *testing.T) {
+	backend, _ := newResponsesTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"incomplete","incomplete_details":{"reason":"max_output_tokens"},"output":[{"type":"message","content":[{"type":"output_text","text":"Cut"}]}]}`)
+	})
+
+	resp, err := backend.CreateChat(context.Background(), testResponsesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "Cut" || resp.FinishReason != "length" {
+		t.Errorf("response = %+v, want content Cut and finish reason length", resp)
+	}
+}
+
+func TestResponsesCreateChatStream(t *testing.T) {
+	backend, requests := newResponsesTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, strings.Join([]string{
+			"event: response.created",
+			`data: {"type":"response.created","response":{"status":"in_progress"}}`,
+			"",
+			"event: response.output_text.delta",
+			`data: {"type":"response.output_text.delta","delta":"Hel"}`,
+			"",
+			"event: response.output_text.delta",
+			`data: {"type":"response.output_text.delta","delta":"lo"}`,
+			"",
+			"event: response.completed",
+			`data: {"type":"response.completed","response":{"status":"completed","usage":{"input_tokens":7,"output_tokens":2}}}`,
+			"",
+		}, "\n"))
+	})
+
+	stream, err := backend.CreateChatStream(context.Background(), testResponsesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var content string
+	var last ChatDelta
+	for {
+		delta, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += delta.Content
+		if delta.FinishReason != "" {
+			last = delta
+		}
+	}
+	if content != "Hello" {
+		t.Errorf("streamed content = %q, want Hello", content)
+	}
+	if last.FinishReason != "stop" || last.Usage == nil || last.Usage.PromptTokens != 7 || last.Usage.CompletionTokens != 2 {
+		t.Errorf("final delta = %+v, want finish reason stop with usage 7/2", last)
+	}
+	if len(*requests) != 1 || !(*requests)[0].Stream {
+		t.Errorf("requests = %+v, want one streaming request", *requests)
+	}
+}
+
+func TestResponsesStreamErrors(t *testing.T) {
+	tests := []struct {
+		name, event, want string
+	}{
+		{"error", `{"type":"error","code":"server_error","message":"Overloaded"}`, "responses stream error: Overloaded"},
+		{"failed", `{"type":"response.failed","response":{"status":"failed","error":{"code":"rate_limit_exceeded","message":"Slow down"}}}`,
+			"responses stream error: rate_limit_exceeded: Slow down"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, _ := newResponsesTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `data: {"type":"response.output_text.delta","delta":"Hi"}`+"\n\n"+"data: "+tt.event+"\n\n")
+			})
+
+			stream, err := backend.CreateChatStream(context.Background(), testResponsesRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			if delta, err := stream.Recv(); err != nil || delta.Content != "Hi" {
+				t.Fatalf("Recv() = %+v, %v, want the first delta", delta, err)
+			}
+			if _, err := stream.Recv(); err == nil || err.Error() != tt.want {
+				t.Errorf("Recv() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponsesErrorResponse(t *testing.T) {
+	backend, _ := newResponsesTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"code":"invalid_value","message":"max_output_tokens: too large"}}`)
+	})
+
+	_, err := backend.CreateChat(context.Background(), testResponsesRequest())
+	if err == nil || !strings.Contains(err.Error(), "status 400: max_output_tokens: too large") {
+		t.Errorf("CreateChat() error = %v, want the API error", err)
+	}
+}
+
+func TestResponsesURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		want     string
+	}{
+		{"openai", Provider{BaseURL: "https://api.example.com/v1/"}, "https://api.example.com/v1/responses"},
+		{"azure default", Provider{BaseURL: "https://res.openai.azure.com", AuthType: AuthTypeAzure},
+			"https://res.openai.azure.com/openai/responses?api-version=" + azureResponsesAPIVersion},
+		{"azure override", Provider{BaseURL: "https://res.openai.azure.com", AuthType: AuthTypeAzure, APIVersion: "2025-05-01-preview"},
+			"https://res.openai.azure.com/openai/responses?api-version=2025-05-01-preview"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := newOpenAIBackend(tt.provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := backend.responsesURL(); got != tt.want {
+				t.Errorf("responsesURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
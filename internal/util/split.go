@@ -0,0 +1,254 @@
+package util
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var fenceRegexp = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})(.*)$")
+
+// MessageLength returns the length of rendered content as Telegram counts it, in UTF-16 code units.
+func MessageLength(content string) int {
+	text, _ := RenderEntities(content)
+	return UTF16Len(text)
+}
+
+// SplitMarkdown splits content into chunks whose rendered length fits within limit.
+// It prefers paragraph and line boundaries, never cuts through a multi-byte character,
+// and closes a code fence at the end of a chunk before reopening it in the next one.
+// The last chunk is left as it is, including a code fence that content leaves open,
+// so that a stream can keep appending to it.
+func SplitMarkdown(content string, limit int) []string {
+	if MessageLength(content) <= limit {
+		return []string{content}
+	}
+	s := splitter{limit: limit}
+	for _, block := range splitBlocks(content) {
+		s.add(block)
+	}
+	if strings.TrimSpace(s.current) != "" {
+		s.chunks = append(s.chunks, s.current)
+	}
+	return s.chunks
+}
+
+type markdownBlock struct {
+	content string
+	opener  string // opening fence line if the block is a fenced code block
+}
+
+type splitter struct {
+	limit   int
+	chunks  []string
+	current string
+}
+
+func (s *splitter) fits(content string) bool {
+	return MessageLength(content) <= s.limit
+}
+
+func (s *splitter) flush() {
+	if strings.TrimSpace(s.current) != "" {
+		s.chunks = append(s.chunks, strings.TrimRight(s.current, "\n"))
+	}
+	s.current = ""
+}
+
+func (s *splitter) add(block markdownBlock) {
+	if s.fits(s.current + block.content) {
+		s.current += block.content
+		return
+	}
+	s.flush()
+	if s.fits(block.content) {
+		s.current = block.content
+		return
+	}
+	if block.opener != "" {
+		s.addFenced(block)
+		return
+	}
+
+	s.addParagraph(block.content)
+}
+
+// addParagraph splits a block by lines, and lines that are still too long by runes.
+// Emphasis and code spans left open at a cut are closed there and reopened in the next chunk.
+func (s *splitter) addParagraph(content string) {
+	placed := ""   // the part of the paragraph already placed
+	reopened := "" // markers the current chunk starts with
+	place := func(piece string) {
+		s.current += piece
+		placed += piece
+	}
+	cut := func() {
+		closers, openers := inlineMarkers(placed)
+		s.current = strings.TrimRight(s.current, " \t\n") + closers
+		s.flush()
+		s.current, reopened = openers, openers
+	}
+
+	for _, line := range splitLines(content) {
+		if s.fits(s.current + line) {
+			place(line)
+			continue
+		}
+		if s.current != reopened {
+			cut()
+		}
+		if s.fits(s.current + line) {
+			place(line)
+			continue
+		}
+		prefix := s.current
+		for i, piece := range s.splitRunes(line, func(piece string) string { return prefix + piece }) {
+			if i > 0 {
+				cut()
+			}
+			place(piece)
+		}
+	}
+}
+
+// inlineMarkers returns the markers that close what paragraph leaves open, and those that reopen it.
+func inlineMarkers(paragraph string) (closers string, openers string) {
+	state := scanInlines(paragraph)
+	for _, delimiter := range state.open {
+		openers += delimiter.marker
+		closers = delimiter.marker + closers
+	}
+	if state.code != "" {
+		openers += state.code
+		closers = state.code + closers
+	}
+	return closers, openers
+}
+
+// addFenced splits a code block by lines, wrapping every piece in its own fence.
+// The last piece of a block that is still open is not closed.
+func (s *splitter) addFenced(block markdownBlock) {
+	closer := fenceRegexp.FindStringSubmatch(block.opener)[1]
+	body := strings.TrimPrefix(block.content, block.opener+"\n")
+	lines := splitLines(body)
+	closed := false
+	if n := len(lines); n > 0 && isFenceCloser(lines[n-1], closer) {
+		lines = lines[:n-1]
+		closed = true
+	}
+
+	wrap := func(code string) string {
+		if code != "" && !strings.HasSuffix(code, "\n") {
+			code += "\n"
+		}
+		return block.opener + "\n" + code + closer + "\n"
+	}
+	code := ""
+	for _, line := range lines {
+		if s.fits(wrap(code + line)) {
+			code += line
+			continue
+		}
+		if code != "" {
+			s.current = wrap(code)
+			s.flush()
+			code = ""
+		}
+		if s.fits(wrap(line)) {
+			code = line
+			continue
+		}
+		pieces := s.splitRunes(line, wrap)
+		for _, piece := range pieces[:len(pieces)-1] {
+			s.current = wrap(piece)
+			s.flush()
+		}
+		code = pieces[len(pieces)-1]
+	}
+	if code == "" {
+		return
+	}
+	if closed {
+		s.current = wrap(code)
+	} else {
+		s.current = block.opener + "\n" + code
+	}
+}
+
+// splitRunes cuts line into the longest rune-aligned pieces that fit once wrapped.
+func (s *splitter) splitRunes(line string, wrap func(string) string) []string {
+	var pieces []string
+	runes := []rune(line)
+	for len(runes) > 0 {
+		low, high := 1, len(runes)
+		for low < high {
+			mid := (low + high + 1) / 2
+			if s.fits(wrap(string(runes[:mid]))) {
+				low = mid
+			} else {
+				high = mid - 1
+			}
+		}
+		// Prefer breaking after whitespace when there is some in the second half.
+		if low < len(runes) {
+			prefix := string(runes[:low])
+			if i := strings.LastIndexAny(prefix, " \t"); i > len(prefix)/2 {
+				low = utf8.RuneCountInString(prefix[:i+1])
+			}
+		}
+		pieces = append(pieces, string(runes[:low]))
+		runes = runes[low:]
+	}
+	return pieces
+}
+
+// splitBlocks separates content into paragraphs and fenced code blocks, keeping trailing blank lines.
+func splitBlocks(content string) []markdownBlock {
+	var blocks []markdownBlock
+	var current markdownBlock
+	closer := ""
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSuffix(line, "\n")
+		if closer != "" {
+			current.content += line
+			if isFenceCloser(trimmed, closer) {
+				closer = ""
+				blocks = append(blocks, current)
+				current = markdownBlock{}
+			}
+			continue
+		}
+		if matches := fenceRegexp.FindStringSubmatch(trimmed); matches != nil &&
+			!(matches[1][0] == '`' && strings.Contains(matches[2], "`")) {
+			if current.content != "" {
+				blocks = append(blocks, current)
+			}
+			closer = matches[1]
+			current = markdownBlock{content: line, opener: trimmed}
+			continue
+		}
+		current.content += line
+		if strings.TrimSpace(trimmed) == "" {
+			blocks = append(blocks, current)
+			current = markdownBlock{}
+		}
+	}
+	if current.content != "" {
+		blocks = append(blocks, current)
+	}
+	return blocks
+}
+
+// splitLines splits content after every line break, dropping the empty remainder.
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func isFenceCloser(line string, opener string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, opener) && strings.Trim(line, opener[:1]) == ""
+}
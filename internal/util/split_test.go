@@ -0,0 +1,114 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMarkdownShortContent(t *testing.T) {
+	chunks := SplitMarkdown("hello *world*", 100)
+	if len(chunks) != 1 || chunks[0] != "hello *world*" {
+		t.Errorf("SplitMarkdown() = %q, want the content unchanged", chunks)
+	}
+}
+
+func TestSplitMarkdownRunes(t *testing.T) {
+	content := strings.Repeat("草莓🍓", 50)
+	chunks := SplitMarkdown(content, 40)
+	if len(chunks) < 2 {
+		t.Fatalf("SplitMarkdown() returned %d chunk(s), want several", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if !utf8.ValidString(chunk) {
+			t.Errorf("chunk %d is not valid UTF-8: %q", i, chunk)
+		}
+		if n := MessageLength(chunk); n > 40 {
+			t.Errorf("chunk %d has length %d, want at most 40", i, n)
+		}
+	}
+	if got := strings.Join(chunks, ""); got != content {
+		t.Errorf("joined chunks = %q, want %q", got, content)
+	}
+}
+
+func TestSplitMarkdownParagraphs(t *testing.T) {
+	content := strings.Repeat("a", 30) + "\n\n" + strings.Repeat("b", 30) + "\n\n" + strings.Repeat("c", 30)
+	chunks := SplitMarkdown(content, 40)
+	want := []string{strings.Repeat("a", 30), strings.Repeat("b", 30), strings.Repeat("c", 30)}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Errorf("SplitMarkdown() = %q, want %q", chunks, want)
+	}
+}
+
+func TestSplitMarkdownClosedFence(t *testing.T) {
+	var lines []string
+	for range 20 {
+		lines = append(lines, "x := 1")
+	}
+	content := "```go\n" + strings.Join(lines, "\n") + "\n```"
+	chunks := SplitMarkdown(content, 60)
+	if len(chunks) < 2 {
+		t.Fatalf("SplitMarkdown() returned %d chunk(s), want several", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if !strings.HasPrefix(chunk, "```go\n") || !strings.HasSuffix(strings.TrimRight(chunk, "\n"), "\n```") {
+			t.Errorf("chunk %d is not a complete code block: %q", i, chunk)
+		}
+	}
+}
+
+// A stream crossing the limit inside a code block keeps appending to the last chunk,
+// so the fence must be left open there for the model's own closing fence.
+func TestSplitMarkdownOpenFenceTail(t *testing.T) {
+	content := "```go\n" + strings.Repeat("x := 1\n", 20)
+	chunks := SplitMarkdown(content, 60)
+	if len(chunks) < 2 {
+		t.Fatalf("SplitMarkdown() returned %d chunk(s), want several", len(chunks))
+	}
+	if !strings.HasSuffix(chunks[0], "\n```") {
+		t.Errorf("first chunk is not closed: %q", chunks[0])
+	}
+	tail := chunks[len(chunks)-1]
+	if strings.Contains(tail, "\n```") {
+		t.Errorf("tail chunk was closed: %q", tail)
+	}
+
+	streamed := tail + "y := 2\n```\nafter"
+	text, entities := RenderEntities(streamed)
+	if strings.Contains(text, "```") {
+		t.Errorf("rendered tail contains a literal fence: %q", text)
+	}
+	if len(entities) != 1 || entities[0].Type != "pre" {
+		t.Fatalf("rendered tail entities = %+v, want a single pre block", entities)
+	}
+	if !strings.HasSuffix(text, "after") || strings.Contains(text[:len(text)-len("after")], "after") {
+		t.Errorf("rendered tail = %q, want text after the code block", text)
+	}
+}
+
+func TestSplitMarkdownKeepsTailNewlines(t *testing.T) {
+	content := strings.Repeat("a", 30) + "\n\n" + strings.Repeat("b", 30) + "\n\n"
+	chunks := SplitMarkdown(content, 40)
+	if tail := chunks[len(chunks)-1]; tail != strings.Repeat("b", 30)+"\n\n" {
+		t.Errorf("tail chunk = %q, want the trailing blank line kept", tail)
+	}
+}
+
+// Emphasis cut by the limit is closed at the end of one chunk and reopened in the next.
+func TestSplitMarkdownEmphasis(t *testing.T) {
+	content := "a **" + strings.Repeat("b ", 30) + "b** c"
+	chunks := SplitMarkdown(content, 40)
+	if len(chunks) < 2 {
+		t.Fatalf("SplitMarkdown() returned %d chunk(s), want several", len(chunks))
+	}
+	for i, chunk := range chunks {
+		text, entities := RenderEntities(chunk)
+		if strings.Contains(text, "*") {
+			t.Errorf("chunk %d renders a literal marker: %q", i, chunk)
+		}
+		if len(entities) != 1 || entities[0].Type != "bold" {
+			t.Errorf("chunk %d entities = %+v, want a single bold span", i, entities)
+		}
+	}
+}
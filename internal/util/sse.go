@@ -0,0 +1,34 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// sseReader reads the data payloads of a server-sent event stream.
+type sseReader struct {
+	reader *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next data payload. A stream that ends without a terminating event yields io.ErrUnexpectedEOF.
+func (r *sseReader) Next() (string, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		data, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "data:")
+		if ok {
+			return strings.TrimSpace(data), nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+const (
+	messageTokenOverhead = 4    // role and separators added around every message
+	imageTokenEstimate   = 1000 // rough cost of one image at the default detail level
+)
+
+// EstimateTokens approximates the number of tokens in text without a tokenizer:
+// about four ASCII characters per token, and one token per other character, which
+// errs on the safe side for CJK text.
+func EstimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// EstimateMessageTokens approximates the number of tokens a message takes up in a request.
+func EstimateMessageTokens(msg ChatMessage) int {
+	tokens := messageTokenOverhead
+	for _, part := range msg.Parts {
+		switch part.Type {
+		case ChatPartText:
+			tokens += EstimateTokens(part.Text)
+		case ChatPartImage:
+			tokens += imageTokenEstimate
+		}
+	}
+	return tokens
+}
+
+// FitContext returns the most recent messages whose estimated size fits within budget tokens.
+// The last message is always kept, even if it alone exceeds the budget.
+func FitContext(msgs []ChatMessage, budget int) []ChatMessage {
+	if len(msgs) == 0 {
+		return msgs
+	}
+	start := len(msgs) - 1
+	used := EstimateMessageTokens(msgs[start])
+	for start > 0 {
+		tokens := EstimateMessageTokens(msgs[start-1])
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start--
+	}
+	return msgs[start:]
+}